@@ -0,0 +1,87 @@
+package buspirate
+
+import (
+	"sort"
+	"time"
+)
+
+// BenchmarkResult is the throughput and latency of one Benchmark workload.
+type BenchmarkResult struct {
+	Name      string        // e.g. "spi bulk 16"
+	Transfers int           // transfers run
+	Bytes     int           // payload bytes, written plus read
+	Elapsed   time.Duration // total time of the transfers
+	Latency   time.Duration // median time of one transfer
+}
+
+// BytesPerSec returns the payload throughput.
+func (r BenchmarkResult) BytesPerSec() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+// TransfersPerSec returns the transfer rate.
+func (r BenchmarkResult) TransfersPerSec() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Transfers) / r.Elapsed.Seconds()
+}
+
+// Benchmark measures the transfer paths of SPI mode at the current speed,
+// for comparing adapters, hosts and options such as WithoutDrain: a Ping,
+// the one byte round trip every command costs, 16 byte bulk transfers,
+// which take a round trip per byte, and 4096 byte write then read
+// transfers, which stream. None of them touches chip select, so a
+// connected device stays deselected, but the clock and MOSI do toggle.
+// I2C transfers need a device to acknowledge them and aren't measured.
+//
+// The bulk transfers dominate the run, at 850 round trips: about a second
+// on a v4, and up to 15s on a v3 at its FTDI bridge's default latency
+// timer. At the slowest speeds the bus rather than the link limits the
+// streaming workload.
+func (bp *BusPirate) Benchmark() ([]BenchmarkResult, error) {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 4096)
+	in := make([]byte, 4096)
+	for i := range out {
+		out[i] = byte(i)
+	}
+	workloads := []struct {
+		name      string
+		transfers int
+		bytes     int
+		run       func() error
+	}{
+		{"ping", 50, 0, bp.Ping},
+		{"spi bulk 16", 50, 32, func() error {
+			return bp.SpiSendInto(out[:16], in)
+		}},
+		{"spi write-read 4096", 5, 8192, func() error {
+			_, err := bp.SpiWriteReadNoCS(out, len(in))
+			return err
+		}},
+	}
+
+	var results []BenchmarkResult
+	for _, w := range workloads {
+		times := make([]time.Duration, w.transfers)
+		res := BenchmarkResult{Name: w.name, Transfers: w.transfers, Bytes: w.transfers * w.bytes}
+		for i := range times {
+			start := time.Now()
+			if err := w.run(); err != nil {
+				return results, err
+			}
+			times[i] = time.Since(start)
+			res.Elapsed += times[i]
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+		res.Latency = times[len(times)/2]
+		results = append(results, res)
+	}
+	return results, nil
+}
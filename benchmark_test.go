@@ -0,0 +1,108 @@
+package buspirate
+
+import (
+	"testing"
+	"time"
+)
+
+// benchLatency stands in for the USB round trip in the benchmarks, a USB
+// frame, so they show what batching and streaming save.
+const benchLatency = time.Millisecond
+
+func benchSpi(b *testing.B, opts ...Option) *BusPirate {
+	f := newFakePort()
+	bp := fakeSpi(b, f, opts...)
+	f.delay = benchLatency
+	return bp
+}
+
+func BenchmarkPing(b *testing.B) {
+	bp := benchSpi(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := bp.Ping(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSpiBulk16 runs a 16 byte bulk transfer with and without
+// WithoutDrain. The fake port drains at once, so the two only differ on a
+// real port.
+func BenchmarkSpiBulk16(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"drain", nil},
+		{"without drain", []Option{WithoutDrain()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			bp := benchSpi(b, bc.opts...)
+			out, in := make([]byte, 16), make([]byte, 16)
+			b.SetBytes(32)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := bp.SpiSendInto(out, in); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSpiWriteRead4096(b *testing.B) {
+	bp := benchSpi(b)
+	out := make([]byte, 4096)
+	b.SetBytes(8192)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bp.SpiWriteReadNoCS(out, len(out)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBenchmark runs the Benchmark workloads end to end.
+func BenchmarkBenchmark(b *testing.B) {
+	bp := benchSpi(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bp.Benchmark(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPinStates compares a 16 edge clock sent with SetPinStatesBatch
+// against the same edges sent one pin command at a time.
+func BenchmarkPinStates(b *testing.B) {
+	cmds := make([]byte, 16)
+	for i := range cmds {
+		cmds[i] = bbPinSet | byte(i&1)*pinCLK
+	}
+	b.Run("batch", func(b *testing.B) {
+		f := newFakePort()
+		bp := fakeBitbang(b, f)
+		f.delay = benchLatency
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := bp.SetPinStatesBatch(cmds); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("per pin", func(b *testing.B) {
+		f := newFakePort()
+		bp := fakeBitbang(b, f)
+		f.delay = benchLatency
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, c := range cmds {
+				if _, err := bp.pinCmd(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
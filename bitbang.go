@@ -0,0 +1,361 @@
+package buspirate
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SetPinStatesBatch sends a sequence of bitbang pin set commands,
+// 1xxxxxxx (POWER|PULLUP|AUX|MOSI|CLK|MISO|CS), in a single port write and
+// returns the pin state reply to each, in order. The device executes the
+// commands back to back in the order given, so a bit-banged waveform costs
+// one USB round trip rather than one per edge.
+func (bp *BusPirate) SetPinStatesBatch(cmds []byte) ([]byte, error) {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return nil, err
+	}
+	for i, c := range cmds {
+		if c&bbPinSet == 0 {
+			return nil, fmt.Errorf("error, pin batch command %d is not a pin set command: 0x%02x", i, c)
+		}
+	}
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if n, err := bp.write(cmds, writeTimeout); n < len(cmds) || err != nil {
+		if err == nil {
+			err = ErrTimeout
+		}
+		return nil, bp.cmdError("error writing pin batch, n: %d, %w", n, err)
+	}
+	if err := bp.drain(); err != nil {
+		return nil, err
+	}
+	states := make([]byte, len(cmds))
+	if n, err := bp.readFull(states, bp.cmdTimeout()); err != nil {
+		return nil, bp.cmdError("error reading pin batch replies, n: %d, %w", n, err)
+	}
+	bp.pinSet = cmds[len(cmds)-1]
+	return states, nil
+}
+
+// HiZMode puts every pin in a high impedance state, the equivalent of the
+// text-mode HiZ menu entry and the safe state in which to attach probes to
+// a target. Any protocol mode is left for bitbang mode, CS, MISO, CLK,
+// MOSI and AUX are all made inputs, and the power supplies and pullups are
+// switched off. Nothing is driven until a mode is entered or pins are set
+// again.
+func (bp *BusPirate) HiZMode() error {
+	if err := bp.BitbangEnter(); err != nil {
+		return err
+	}
+	// inputs first, so clearing the outputs can't drive a pin low
+	if _, err := bp.pinCmd(bbPinDir | pinAUX | pinMOSI | pinCLK | pinMISO | pinCS); err != nil {
+		return err
+	}
+	_, err := bp.pinCmd(bbPinSet)
+	return err
+}
+
+// Pin is a bitbang mode I/O pin, named by its SPI function.
+type Pin byte
+
+// Bitbang mode I/O pins, with their bit in the pin state byte.
+const (
+	PinCS   Pin = pinCS
+	PinMISO Pin = pinMISO
+	PinCLK  Pin = pinCLK
+	PinMOSI Pin = pinMOSI
+	PinAUX  Pin = pinAUX
+)
+
+func (p Pin) String() string {
+	switch p {
+	case PinCS:
+		return "CS"
+	case PinMISO:
+		return "MISO"
+	case PinCLK:
+		return "CLK"
+	case PinMOSI:
+		return "MOSI"
+	case PinAUX:
+		return "AUX"
+	}
+	return fmt.Sprintf("Pin(0x%02x)", byte(p))
+}
+
+// pinMappings are the pin functions of each mode, as the firmware's
+// binary modes use them.
+var pinMappings = map[Mode]map[Pin]string{
+	ModeBitbang: {
+		PinCS:   "GPIO",
+		PinMISO: "GPIO",
+		PinCLK:  "GPIO",
+		PinMOSI: "GPIO",
+		PinAUX:  "GPIO, PWM output",
+	},
+	ModeSpi: {
+		PinCS:   "CS, chip select",
+		PinMISO: "MISO, data in",
+		PinCLK:  "CLK, clock",
+		PinMOSI: "MOSI, data out",
+		PinAUX:  "AUX",
+	},
+	ModeI2c: {
+		PinCS:   "unused",
+		PinMISO: "unused",
+		PinCLK:  "SCL, clock",
+		PinMOSI: "SDA, data",
+		PinAUX:  "AUX",
+	},
+	ModeUart: {
+		PinCS:   "unused",
+		PinMISO: "RX, to the target's TX",
+		PinCLK:  "unused",
+		PinMOSI: "TX, to the target's RX",
+		PinAUX:  "AUX",
+	},
+	ModeRawWire: {
+		PinCS:   "CS, chip select",
+		PinMISO: "data in (3-wire), unused (2-wire)",
+		PinCLK:  "CLK, clock",
+		PinMOSI: "data out (3-wire), data (2-wire)",
+		PinAUX:  "AUX",
+	},
+}
+
+// PinMapping returns the function of each pin in mode, e.g. "SDA, data" for
+// MOSI in I2C mode, for tools showing how to wire a target; pins a mode
+// doesn't use are "unused". The pins are named by their SPI function, as
+// on the cable and the board's silkscreen. In text mode, whose pins depend
+// on the mode selected from its menu, and for an unknown mode, PinMapping
+// returns nil. The returned map is the caller's to change.
+func PinMapping(mode Mode) map[Pin]string {
+	m, ok := pinMappings[mode]
+	if !ok {
+		return nil
+	}
+	out := make(map[Pin]string, len(m))
+	for p, f := range m {
+		out[p] = f
+	}
+	return out
+}
+
+// PinWalk drives CS, MISO, CLK, MOSI and AUX high for interval and then low
+// for interval, one at a time and in that order, in bitbang mode, to check
+// the wiring to a target with a meter or scope before debugging a
+// protocol. See PinWalkContext.
+func (bp *BusPirate) PinWalk(interval time.Duration) error {
+	return bp.PinWalkContext(context.Background(), interval)
+}
+
+// PinWalkContext is PinWalk that stops early when ctx is done, returning
+// its error, and walks pins in the order given instead, e.g. a pin twice
+// or only the pins wired up. The walked pins are made outputs, the others
+// left as inputs; the power supply and pullups are left as they were.
+// However the walk ends, every pin is then driven low and made an input.
+func (bp *BusPirate) PinWalkContext(ctx context.Context, interval time.Duration, pins ...Pin) (err error) {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
+	if len(pins) == 0 {
+		pins = []Pin{PinCS, PinMISO, PinCLK, PinMOSI, PinAUX}
+	}
+	all := byte(pinAUX | pinMOSI | pinCLK | pinMISO | pinCS)
+	outputs := byte(0)
+	for _, p := range pins {
+		if byte(p)&^all != 0 || p == 0 {
+			return fmt.Errorf("error, invalid pin walk pin: %v", p)
+		}
+		outputs |= byte(p)
+	}
+	set := bbPinSet | bp.pinSet&(pinPower|pinPullup)
+
+	defer func() {
+		if _, rerr := bp.pinCmd(set); err == nil {
+			err = rerr
+		}
+		if _, rerr := bp.pinCmd(bbPinDir | all); err == nil {
+			err = rerr
+		}
+	}()
+	// outputs low before they're driven
+	if _, err := bp.pinCmd(set); err != nil {
+		return err
+	}
+	if _, err := bp.pinCmd(bbPinDir | all&^outputs); err != nil {
+		return err
+	}
+	for _, p := range pins {
+		for _, cmd := range []byte{set | byte(p), set} {
+			if _, err := bp.pinCmd(cmd); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+	}
+	return nil
+}
+
+// WaitForPin polls the pin states in bitbang mode until pin reads level,
+// e.g. a sensor's data ready line wired to AUX, failing with ErrTimeout if
+// it hasn't after timeout. pin should be an input, as all pins are after
+// entering bitbang mode; the current pin directions are re-sent to read
+// the states and are left unchanged.
+//
+// Each poll is a USB round trip: around 1ms on a v4, and on a v3 whatever
+// its FTDI bridge's latency timer allows, up to 16ms at the default. A
+// pulse shorter than that can be missed, so this suits level signals that
+// stay asserted until serviced.
+func (bp *BusPirate) WaitForPin(pin Pin, level bool, timeout time.Duration) error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
+	dir := bp.pinDir
+	if dir == 0 {
+		dir = bbPinDir | pinAUX | pinMOSI | pinCLK | pinMISO | pinCS
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := bp.pinCmd(dir)
+		if err != nil {
+			return err
+		}
+		if (state&byte(pin) != 0) == level {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			want := "low"
+			if level {
+				want = "high"
+			}
+			return fmt.Errorf("error waiting for pin %v to go %s, %w", pin, want, ErrTimeout)
+		}
+	}
+}
+
+// PulseReset pulses a target's reset line, in bitbang mode: pin is driven
+// to its active level, low if activeLow is set and high if not, for
+// duration, and then released. Typically CS or AUX is wired to the
+// target's RESET pin, with the grounds joined; most resets are active low
+// with a pullup on the target.
+//
+// A pin that's an input, as all are after entering bitbang mode, is made
+// an output only for the pulse and released by making it an input again,
+// so the target's own pullup or pulldown ends the reset; an output is
+// released by driving it to the inactive level, where it stays. The pulse
+// lasts at least duration, plus a USB round trip.
+func (bp *BusPirate) PulseReset(pin Pin, activeLow bool, duration time.Duration) error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
+	if pin == 0 || byte(pin)&^(pinAUX|pinMOSI|pinCLK|pinMISO|pinCS) != 0 || byte(pin)&(byte(pin)-1) != 0 {
+		return fmt.Errorf("error, invalid reset pin: %v", pin)
+	}
+	dir := bp.pinDir
+	if dir == 0 {
+		dir = bbPinDir | pinAUX | pinMOSI | pinCLK | pinMISO | pinCS
+	}
+	set := bp.pinSet | bbPinSet
+	active, inactive := set|byte(pin), set&^byte(pin)
+	if activeLow {
+		active, inactive = inactive, active
+	}
+
+	// set the level before driving it, so an input never glitches
+	if _, err := bp.pinCmd(active); err != nil {
+		return err
+	}
+	input := dir&byte(pin) != 0
+	if input {
+		if _, err := bp.pinCmd(dir &^ byte(pin)); err != nil {
+			return err
+		}
+	}
+	time.Sleep(duration)
+	if input {
+		if _, err := bp.pinCmd(dir); err != nil {
+			return err
+		}
+	}
+	_, err := bp.pinCmd(inactive)
+	return err
+}
+
+// pulseTimeout bounds the wait for the edges MeasurePulseWidth times.
+const pulseTimeout = 2 * time.Second
+
+// MeasurePulseWidth measures one high and one low pulse of a signal on AUX,
+// in bitbang mode, e.g. to work out the duty cycle of a PWM output of the
+// target: high / (high + low). AUX is made an input. The firmware has no
+// pulse timing command, so the pin is polled, each edge being placed
+// midway between the polls either side of it, and the measurement fails
+// with ErrTimeout if three edges aren't seen within 2s.
+//
+// The resolution is the USB round trip of a poll: about 1ms on a v4, and on
+// a v3 up to 16ms with its FTDI bridge's default latency timer. Pulses
+// much longer than that, below roughly 10Hz at mid duty, measure to within
+// a poll either way; shorter pulses are missed or merged with their
+// neighbours, and the result is meaningless.
+func (bp *BusPirate) MeasurePulseWidth() (high, low time.Duration, err error) {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return 0, 0, err
+	}
+	dir := bp.pinDir
+	if dir == 0 {
+		dir = bbPinDir | pinMOSI | pinCLK | pinMISO | pinCS
+	}
+	dir |= pinAUX
+	deadline := time.Now().Add(pulseTimeout)
+
+	state, err := bp.pinCmd(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	level := state&pinAUX != 0
+	last := time.Now()
+	var edges []time.Time
+	var firstHigh bool // level after the first edge
+	for len(edges) < 3 {
+		if time.Now().After(deadline) {
+			return 0, 0, fmt.Errorf("error, %d of 3 edges seen on AUX in %v, %w", len(edges), pulseTimeout, ErrTimeout)
+		}
+		state, err := bp.pinCmd(dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		now := time.Now()
+		if l := state&pinAUX != 0; l != level {
+			if len(edges) == 0 {
+				firstHigh = l
+			}
+			edges = append(edges, last.Add(now.Sub(last)/2))
+			level = l
+		}
+		last = now
+	}
+	first, second := edges[1].Sub(edges[0]), edges[2].Sub(edges[1])
+	if firstHigh {
+		return first, second, nil
+	}
+	return second, first, nil
+}
+
+// SetModeLED would switch the MODE LED. The firmware drives the LED itself,
+// lighting it whenever a mode other than HiZ is active, and neither the
+// binary protocol nor the text menus of any released v3 or v4 firmware
+// have a command for it, so this returns ErrUnsupported. It's here so that
+// tools can probe for the capability rather than hard-code its absence.
+func (bp *BusPirate) SetModeLED(on bool) error {
+	if err := bp.checkMode(binaryModes...); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: mode led control on a %s board", ErrUnsupported, bp.board)
+}
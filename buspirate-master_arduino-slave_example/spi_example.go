@@ -9,6 +9,8 @@ SS   pin 10       White
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"runtime"
 	"time"
@@ -31,7 +33,6 @@ func init() {
 func main() {
 	fmt.Println("opening bp...")
 	bp, err := buspirate.Open("/dev/ttyUSB0", baudrate)
-	// bp, err := buspirate.Open("/dev/ttyUSB0", 5*time.Second)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -126,7 +127,13 @@ func main() {
 		out[i] = byte(i + 1)
 	}
 
-	if err := bp.SpiWriteRead(out, in); err != nil {
+	// a slave that never answers the block command fails promptly
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := bp.SpiWriteReadContext(ctx, out, in); err != nil {
+		if errors.Is(err, buspirate.ErrTimeout) {
+			fmt.Println("slave did not respond to the block command")
+		}
 		fmt.Println(err)
 		return
 	}
@@ -1,17 +1,99 @@
 package buspirate
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/bits"
+	"os"
 	"runtime"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/jpoirier/lsport"
 )
 
 // BusPirate represents a connection to a Bus Pirate device.
+//
+// All of a connection's state lives in its BusPirate; the package has no
+// mutable globals, so any number of boards can be driven at once, each on
+// its own port and goroutine, without affecting one another. A single
+// BusPirate is not safe for concurrent use: its commands are exchanges on
+// one serial line, so calls must not overlap, with the exception of Stats,
+// which may be read from any goroutine.
 type BusPirate struct {
+	// Term is the serial port, embedded so its methods are available for
+	// tuning the port beyond what BusPirate exposes. Between commands it's
+	// safe to flush its buffers or change port parameters that don't
+	// affect the line, e.g. flow control. Changing the baud rate desyncs
+	// the device, which only changes it through the text-mode menu. Reads
+	// and writes on the Term bypass the state BusPirate keeps about the
+	// device and its Stats; a session that issues raw commands should
+	// return the device to bitbang mode with BitbangEnter before using
+	// BusPirate methods again.
 	*lsport.Term
+
+	port serialPort // the Term, which every command goes through
+
+	mode         Mode
+	streaming    atomic.Bool // a stream goroutine owns the port
+	board        string      // "v3" or "v4", from the info command at Open
+	info         string      // the info command reply at Open
+	baudDetect   bool        // look for the device at other baud rates at Open
+	detectedBaud int         // baud rate the device was found at, 0 for 115200
+	preamble     int         // newlines sent ahead of the binary mode handshake
+	stats        stats
+	drainLogged  bool // the drain fallback has been logged
+
+	spiCSActiveHigh bool          // chip select polarity
+	spiCSKeep       bool          // leave chip select alone on SpiEnter
+	spiStrictCS     bool          // refuse SpiSend with chip select deasserted
+	spiCSSettle     time.Duration // CS to data delay in SpiWriteRead
+	spiChunk        int           // SpiWriteRead chunk size, 0 for 4096
+	spiCSPin        Pin           // pin SpiSelect drives, 0 for CS
+	spiFill         byte          // byte clocked out by the SPI read helpers
+	periphVerify    bool          // read back the peripheral config after setting it
+	strictAcks      bool          // fail on bytes following a config command's reply
+	panicRecovery   bool          // RunInMode returns panics as errors
+
+	onRetry func(attempt int, err error) // OpenWithRetry's retry hook
+
+	textMode     bool                   // leave the device in text mode at Open
+	noDrain      bool                   // skip the Drain after each write
+	readDelay    time.Duration          // wait between a write and its reply read
+	modeTimeouts map[Mode]time.Duration // reply read timeouts by mode
+	echoSkip     bool                   // drop echoed command bytes from replies
+	echo         []byte                 // last bytes written, while not yet skipped
+	wire         wireLog                // command bytes for CommandError
+
+	// last peripheral config applied in a protocol mode
+	periph byte
+
+	// last SPI settings applied, re-issued when SPI mode is re-entered
+	spiSpeed byte
+	spiCfg   byte
+	spiCS    byte
+
+	// last I2C speed applied
+	i2cSpeed byte
+
+	// last UART speed and configuration applied
+	uartSpeed byte
+	uartCfg   byte
+
+	// last bitbang pin direction and pin set commands, 0 while the pins
+	// are as the reset into bitbang mode leaves them: inputs, all off
+	pinDir byte
+	pinSet byte
+
+	// last PWM settings applied
+	pwmPrescale byte
+	pwmOCR      uint16
+	pwmPRy      uint16
 }
 
 // V3
@@ -26,57 +108,316 @@ const (
 // Open opens a connection to a Bus Pirate device and places it in binary mode.
 // Supported baud rates in addition to the standard ones below 115200:
 // 500000, 1000000, and non Windows 2000000
-func Open(dev string, baudrate int) (*BusPirate, error) {
+//
+// A baud rate other than 115200 is set on a v3 board through the text-mode
+// 'b' menu, and the board keeps it until it's power cycled, not just until
+// the port is closed. Since the board stays powered while it's plugged in,
+// a later Open, or a terminal, at 115200 then gets no answer;
+// ResetBaudrateToDefault recovers such a board without unplugging it. Pass
+// 115200 to leave the board's baud rate alone. The v4 talks USB directly
+// and its baud rate is ignored. With WithBaudDetect, Open finds such a
+// board itself.
+//
+// A device left in a binary mode by a previous session, e.g. one that
+// crashed, is first returned to text mode: a 0x00 takes any protocol mode
+// back to bitbang mode, where the device answers "BBIO1", and a 0x0F then
+// resets it to text mode. A device already in text mode ignores the lone
+// 0x00 and isn't reset.
+func Open(dev string, baudrate int, opts ...Option) (*BusPirate, error) {
 	// default baud rate is 115200 at boot-up
 	term, err := lsport.Open(dev, 115200)
 	if err != nil {
 		return nil, err
 	}
+	return open(term, baudrate, opts)
+}
+
+// OpenWithRetry is Open retrying the port open until it succeeds or ctx is
+// done, for scripts that run right after the board is plugged in, when the
+// device node may not exist yet or may briefly refuse to open while it's
+// set up. Only those failures are retried, every 100ms: the port not being
+// found (ENOENT, ENXIO) or being busy (EBUSY), told by the errno or the
+// error message. Anything else, e.g. a permission error, fails at once, as
+// do the steps after the port is open. The OnRetry option reports each
+// failure that's retried.
+func OpenWithRetry(ctx context.Context, dev string, baudrate int, opts ...Option) (*BusPirate, error) {
+	return openWithRetry(ctx, func() (serialPort, error) {
+		term, err := lsport.Open(dev, 115200)
+		if err != nil {
+			return nil, err
+		}
+		return term, nil
+	}, dev, baudrate, opts)
+}
+
+// openWithRetry is OpenWithRetry opening the port with openPort.
+func openWithRetry(ctx context.Context, openPort func() (serialPort, error), dev string, baudrate int, opts []Option) (*BusPirate, error) {
+	// the options are applied again by open; only OnRetry is wanted here
+	var cfg BusPirate
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	for attempt := 1; ; attempt++ {
+		term, err := openPort()
+		if err == nil {
+			return open(term, baudrate, opts)
+		}
+		if !openRetryable(err) {
+			return nil, err
+		}
+		if cfg.onRetry != nil && ctx.Err() == nil {
+			cfg.onRetry(attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error opening %s, %w, last error: %v", dev, ctx.Err(), err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// openRetryable reports whether a port open failed because the port isn't
+// there yet or is busy. lsport's errors don't always wrap the errno, so as
+// for disconnected the message is checked too: ENOENT and ENXIO on Linux
+// and macOS, "cannot find the file" on Windows, and EBUSY.
+func openRetryable(err error) bool {
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.ENOENT, syscall.ENXIO, syscall.EBUSY} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{
+		"no such file or directory",
+		"no such device or address",
+		"device not configured",
+		"cannot find the file",
+		"resource busy",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func open(term serialPort, baudrate int, opts []Option) (*BusPirate, error) {
+	bp := newBusPirate(term, opts)
+
+	if err := recoverTextMode(term); err != nil {
+		return nil, err
+	}
 
 	// board: v3 - FTDI USB to serial chip, v4 - PIC integrated USB
-	board, err := getBPVersion(term)
+	board, info, err := getBPVersion(term)
+	current := 115200
+	if bp.baudDetect && (err != nil || !strings.Contains(info, infoBanner)) {
+		current, board, info, err = detectBaudrate(term)
+		if err == nil {
+			bp.detectedBaud = current
+		}
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w; a board left at another baud rate by an earlier Open can be reset with ResetBaudrateToDefault", err)
 	}
+	bp.board, bp.info = board, info
 
-	if baudrate != 115200 && board == "v3" {
-		err = resetBaudrate(term, baudrate)
-		if err != nil {
-			return nil, err
+	if baudrate != current && board == "v3" {
+		if baudrate == 115200 {
+			if err := resetBaudrateDefault(term); err != nil {
+				return nil, err
+			}
+		} else {
+			err = resetBaudrate(term, baudrate)
+			if err != nil {
+				return nil, err
+			}
+			err = term.SetBaudrate(baudrate)
+			if err != nil {
+				return nil, err
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			reply := make([]byte, 20)
+			term.Write([]byte{0x20}) // space character to confirm the baud rate change
+			termRead(term, reply, 10*time.Millisecond)
 		}
-		err = term.SetBaudrate(baudrate)
-		if err != nil {
-			return nil, err
+	}
+	if bp.textMode {
+		return bp, nil
+	}
+	return bp, bp.enterBinaryMode()
+}
+
+// newBusPirate returns a BusPirate on term with the defaults and opts
+// applied, before anything is sent to the device.
+func newBusPirate(term serialPort, opts []Option) *BusPirate {
+	bp := &BusPirate{port: term, preamble: 10, spiFill: 0xFF}
+	if t, ok := term.(*lsport.Term); ok {
+		bp.Term = t
+	}
+	for _, opt := range opts {
+		opt(bp)
+	}
+	return bp
+}
+
+// infoBanner starts the info command reply of every board.
+const infoBanner = "Bus Pirate"
+
+// detectBaudrate looks for the device at the baud rates Open can leave a
+// v3 board at, returning the first one at which it answers the info
+// command. The port is returned to 115200 if it answers at none.
+func detectBaudrate(term serialPort) (baudrate int, board, info string, err error) {
+	for _, baudrate = range []int{500000, 1000000, 2000000} {
+		if baudrate == 2000000 && runtime.GOOS == "windows" {
+			continue
+		}
+		if err := term.SetBaudrate(baudrate); err != nil {
+			return 0, "", "", err
 		}
 		time.Sleep(10 * time.Millisecond)
+		term.Flush(lsport.BufInput)
+		if err := recoverTextMode(term); err != nil {
+			return 0, "", "", err
+		}
+		board, info, err = getBPVersion(term)
+		if err == nil && strings.Contains(info, infoBanner) {
+			return baudrate, board, info, nil
+		}
+	}
+	if err := term.SetBaudrate(115200); err != nil {
+		return 0, "", "", err
+	}
+	return 0, "", "", fmt.Errorf("error, no board info reply at 115200, 500000, 1000000 or 2000000 baud")
+}
 
-		reply := make([]byte, 20)
-		term.Write([]byte{0x20}) // space character to confirm the baud rate change
-		term.BlockingRead(reply, 10)
+// DetectedBaudrate returns the baud rate WithBaudDetect found the device
+// at when it didn't answer at 115200, or 0. A v3 board found at another
+// rate was left there by an earlier Open; ResetBaudrateToDefault, or a
+// power cycle, returns it to 115200 for tools that don't detect it.
+func (bp *BusPirate) DetectedBaudrate() int {
+	return bp.detectedBaud
+}
+
+// recoverTextMode returns a device left in a binary mode to text mode.
+func recoverTextMode(term serialPort) error {
+	if n, err := termWrite(term, []byte{resetBitbangMode}, writeTimeout); n == 0 || err != nil {
+		return fmt.Errorf("error writing binary mode probe, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := termDrain(term); err != nil {
+		return err
+	}
+	reply := make([]byte, 5)
+	n, _ := termRead(term, reply, 100*time.Millisecond)
+	if !strings.Contains(string(reply[:n]), "BBIO") {
+		term.Flush(lsport.BufInput)
+		return nil
+	}
+	if n, err := termWrite(term, []byte{0x0F}, writeTimeout); n == 0 || err != nil {
+		return fmt.Errorf("error writing binary mode reset, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := termDrain(term); err != nil {
+		return err
+	}
+	// the 0x01 reply is followed by the text-mode banner once the device
+	// has reset; drop both
+	time.Sleep(500 * time.Millisecond)
+	buf := make([]byte, 64)
+	for i := 0; i < 100; i++ {
+		if n, err := termRead(term, buf, 50*time.Millisecond); n == 0 || err != nil {
+			break
+		}
 	}
-	bp := BusPirate{term}
-	return &bp, bp.enterBinaryMode()
+	term.Flush(lsport.BufInput)
+	return nil
 }
 
-func getBPVersion(term *lsport.Term) (string, error) {
+func getBPVersion(term serialPort) (board, info string, err error) {
 	if n, err := term.Write([]byte("i\n")); n == 0 || err != nil {
-		return "", fmt.Errorf("error writing board info command, n: %d, %v", n, err)
+		return "", "", fmt.Errorf("error writing board info command, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := term.Drain(); err != nil {
-		return "", err
+	if err := termDrain(term); err != nil {
+		return "", "", err
 	}
 	reply := make([]byte, 200)
-	if n, err := term.BlockingRead(reply, 500); n == 0 || err != nil {
-		return "", fmt.Errorf("error reading board info command reply, n: %d, %v", n, err)
+	n, err := termRead(term, reply, 500*time.Millisecond)
+	if n == 0 || err != nil {
+		return "", "", fmt.Errorf("error reading board info command reply, n: %d, %w", n, timeoutErr(n, err))
+	}
+	info = string(reply[:n])
+	if strings.Contains(info, "v4") {
+		return "v4", info, nil
+	}
+	return "v3", info, nil
+}
+
+// ResetBaudrateToDefault returns a v3 board left at baudrate by an earlier
+// Open to the default 115200. The port is opened at baudrate, the board is
+// returned to text mode if it was left in a binary mode, and 115200 is
+// selected in the 'b' menu. The port is closed again; Open the board as
+// usual afterwards.
+func ResetBaudrateToDefault(dev string, baudrate int) error {
+	term, err := lsport.Open(dev, baudrate)
+	if err != nil {
+		return err
+	}
+	defer term.Close()
+	if err := recoverTextMode(term); err != nil {
+		return err
+	}
+	return resetBaudrateDefault(term)
+}
+
+// resetBaudrateDefault selects 115200 in the 'b' menu and switches the port
+// to it.
+func resetBaudrateDefault(term serialPort) error {
+	if n, err := term.Write([]byte("b\n")); n == 0 || err != nil {
+		return fmt.Errorf("error writing baudrate command, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if strings.Contains(string(reply), "v4") {
-		return "v4", nil
+	if err := termDrain(term); err != nil {
+		return err
+	}
+	reply := make([]byte, len(baudReply)+10)
+	if n, err := termRead(term, reply, 500*time.Millisecond); n == 0 || err != nil {
+		return fmt.Errorf("error reading baudrate command reply, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if !strings.Contains(string(reply), expectBaudReply) {
+		return fmt.Errorf("error, baudrate command reply is invalid")
+	}
+
+	// 9 is the menu's 115200 entry
+	if n, err := term.Write([]byte("9\n")); n == 0 || err != nil {
+		return fmt.Errorf("error writing baudrate value, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := termDrain(term); err != nil {
+		return err
+	}
+	reply = make([]byte, len(brgValReply)+10)
+	if n, err := termRead(term, reply, 500*time.Millisecond); n == 0 || err != nil {
+		return fmt.Errorf("error reading baudrate value reply, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if !strings.Contains(string(reply), expectBrgValReply) {
+		return fmt.Errorf("error, baudrate value reply is invalid")
 	}
-	return "v3", nil
+
+	if err := term.SetBaudrate(115200); err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	// space character to confirm the baud rate change
+	if n, err := term.Write([]byte{0x20}); n == 0 || err != nil {
+		return fmt.Errorf("error writing baudrate confirmation, n: %d, %w", n, timeoutErr(n, err))
+	}
+	return termDrain(term)
 }
 
-// resetBaudrate resets (non-volatile) the Bus Pirate's baud rate.
-func resetBaudrate(term *lsport.Term, buadrate int) error {
+// resetBaudrate sets the Bus Pirate's baud rate. It holds until the board
+// is power cycled or ResetBaudrateToDefault is used.
+func resetBaudrate(term serialPort, buadrate int) error {
 	var brg string
 	switch buadrate {
 	case 500000:
@@ -94,14 +435,14 @@ func resetBaudrate(term *lsport.Term, buadrate int) error {
 
 	// baud rate mode
 	if n, err := term.Write([]byte("b\n")); n == 0 || err != nil {
-		return fmt.Errorf("error writing baudrate command, n: %d, %v", n, err)
+		return fmt.Errorf("error writing baudrate command, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := term.Drain(); err != nil {
+	if err := termDrain(term); err != nil {
 		return err
 	}
 	reply := make([]byte, len(baudReply)+10)
-	if n, err := term.BlockingRead(reply, 500); n == 0 || err != nil {
-		return fmt.Errorf("error reading baudrate command reply, n: %d, %v", n, err)
+	if n, err := termRead(term, reply, 500*time.Millisecond); n == 0 || err != nil {
+		return fmt.Errorf("error reading baudrate command reply, n: %d, %w", n, timeoutErr(n, err))
 	}
 	if !strings.Contains(string(reply), expectBaudReply) {
 		return fmt.Errorf("error, baudrate command reply is invalid")
@@ -109,14 +450,14 @@ func resetBaudrate(term *lsport.Term, buadrate int) error {
 
 	// brg mode
 	if n, err := term.Write([]byte("10\n")); n == 0 || err != nil {
-		return fmt.Errorf("error writing brg command, n: %d, %v", n, err)
+		return fmt.Errorf("error writing brg command, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := term.Drain(); err != nil {
+	if err := termDrain(term); err != nil {
 		return err
 	}
 	reply = make([]byte, len(brgReply)+10)
-	if n, err := term.BlockingRead(reply, 500); n == 0 || err != nil {
-		return fmt.Errorf("error reading brg command reply, n: %d, %v", n, err)
+	if n, err := termRead(term, reply, 500*time.Millisecond); n == 0 || err != nil {
+		return fmt.Errorf("error reading brg command reply, n: %d, %w", n, timeoutErr(n, err))
 	}
 	if !strings.Contains(string(reply), brgReply) {
 		return fmt.Errorf("error, brg command reply is invalid")
@@ -124,14 +465,14 @@ func resetBaudrate(term *lsport.Term, buadrate int) error {
 
 	// brg value
 	if n, err := term.Write([]byte(brg)); n == 0 || err != nil {
-		return fmt.Errorf("error writing brg value, n: %d, %v", n, err)
+		return fmt.Errorf("error writing brg value, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := term.Drain(); err != nil {
+	if err := termDrain(term); err != nil {
 		return err
 	}
 	reply = make([]byte, len(brgValReply)+10)
-	if n, err := term.BlockingRead(reply, 500); n == 0 || err != nil {
-		return fmt.Errorf("error reading brg value reply, n: %d, %v", n, err)
+	if n, err := termRead(term, reply, 500*time.Millisecond); n == 0 || err != nil {
+		return fmt.Errorf("error reading brg value reply, n: %d, %w", n, timeoutErr(n, err))
 	}
 	if !strings.Contains(string(reply), expectBrgValReply) {
 		return fmt.Errorf("error, brg value reply is invalid")
@@ -140,93 +481,602 @@ func resetBaudrate(term *lsport.Term, buadrate int) error {
 	return nil
 }
 
+// EnterBinary places a device opened WithoutBinaryMode, or returned to
+// text mode with BitbangLeave, in binary bitbang mode, as Open does by
+// default.
+func (bp *BusPirate) EnterBinary() error {
+	if err := bp.checkMode(ModeText); err != nil {
+		return err
+	}
+	return bp.enterBinaryMode()
+}
+
 func (bp *BusPirate) enterBinaryMode() error {
-	bp.Write([]byte{'\n', '\n', '\n'})
-	bp.Flush(lsport.BufBoth)
+	// Enter accepts the default or re-prompts in every text-mode menu, so
+	// enough of them walk the device back to the top-level prompt. Whatever
+	// the device prints in response is drained before the handshake.
+	bp.write(bytes.Repeat([]byte{'\n'}, bp.preamble), writeTimeout)
+	bp.drain()
+	bp.discardInput()
+	bp.port.Flush(lsport.BufBoth)
 	buf := make([]byte, 5)
 	for i := 0; i < 30; i++ {
 		// send binary reset
-		if n, err := bp.Write([]byte{0x00}); n == 0 || err != nil {
-			return fmt.Errorf("error writing binary mode command, n: %d, %v", n, err)
+		if n, err := bp.write([]byte{0x00}, writeTimeout); n == 0 || err != nil {
+			return bp.cmdError("error writing binary mode command, n: %d, %w", n, timeoutErr(n, err))
 		}
-		if err := bp.Drain(); err != nil {
+		if err := bp.drain(); err != nil {
 			return err
 		}
-		if n, err := bp.BlockingRead(buf, 10); n == 0 || err != nil {
+		if n, err := bp.read(buf, 10*time.Millisecond); n == 0 || err != nil {
 			continue
 		}
 		if string(buf) == "BBIO1" {
+			bp.mode = ModeBitbang
+			bp.pinDir, bp.pinSet = 0, 0
 			return nil
 		}
 	}
-	return fmt.Errorf("error, could not enter binary mode")
+	return bp.cmdError("error, could not enter binary mode")
+}
+
+// discardInput reads and drops input until the device goes quiet.
+func (bp *BusPirate) discardInput() {
+	buf := make([]byte, 64)
+	for i := 0; i < 100; i++ {
+		if n, err := bp.read(buf, 20*time.Millisecond); n == 0 || err != nil {
+			return
+		}
+	}
+}
+
+// flushInput drops what the device is still sending along with anything
+// already buffered, so that a failed exchange doesn't leave stale bytes to
+// be read as the reply to a retry.
+func (bp *BusPirate) flushInput() {
+	bp.discardInput()
+	bp.port.Flush(lsport.BufInput)
 }
 
 // CloseTerm closes the terminal connection to the Bus Pirate device.
 func (bp *BusPirate) CloseTerm() error {
-	return bp.Close()
+	return bp.port.Close()
 }
 
 // LeaveBinaryMode exits binary mode.
 func (bp *BusPirate) LeaveBinaryMode() error {
-	if n, err := bp.BlockingWrite([]byte{0x0F}, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error leaving binary mode, n: %d, %v", n, err)
+	if n, err := bp.write([]byte{0x0F}, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error leaving binary mode, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return err
 	}
-	if err := bp.Drain(); err != nil {
+	bp.mode = ModeText
+	if err := bp.port.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// BitbangEnter returns to binary bitbang mode from any protocol mode,
+// verifying the "BBIO1" reply. The pin, power, PWM, ADC and frequency
+// commands are all bitbang mode commands.
+func (bp *BusPirate) BitbangEnter() error {
+	if err := bp.checkMode(binaryModes...); err != nil {
 		return err
 	}
-	if err := bp.Close(); err != nil {
+	if err := bp.bitbangReset(); err != nil {
 		return err
 	}
+	bp.clearModeState()
 	return nil
 }
 
+// ToBitbang returns the device to a clean bitbang mode from wherever it is:
+// any protocol mode, the middle of a command left unfinished by an earlier
+// error, or text mode. Pending input, e.g. UART RX echo, is flushed first,
+// and the binary reset is repeated, up to the 20 times that entry from
+// text mode takes, until the device answers "BBIO1". The pins are left as
+// the reset sets them, all inputs, and the stored mode settings are
+// cleared.
+func (bp *BusPirate) ToBitbang() error {
+	if bp.streaming.Load() {
+		return ErrStreamActive
+	}
+	bp.flushInput()
+	buf := make([]byte, 5)
+	for i := 0; i < 20; i++ {
+		if n, err := bp.write([]byte{resetBitbangMode}, writeTimeout); n == 0 || err != nil {
+			return bp.cmdError("error writing bitbang reset, n: %d, %w", n, timeoutErr(n, err))
+		}
+		if err := bp.drain(); err != nil {
+			return err
+		}
+		// a protocol mode answers the first reset; a device that was mid
+		// command may take several to get back to the command loop
+		if n, _ := bp.readFull(buf, 20*time.Millisecond); n == len(buf) && string(buf) == "BBIO1" {
+			bp.mode = ModeBitbang
+			bp.pinDir, bp.pinSet = 0, 0
+			bp.clearModeState()
+			bp.flushInput()
+			return nil
+		}
+	}
+	return bp.cmdError("error, no bitbang reset reply")
+}
+
+// BitbangLeave exits bitbang mode, resetting the device to text mode. The
+// port is left open.
+func (bp *BusPirate) BitbangLeave() error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
+	buf := []byte{0x0F}
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing leave bitbang mode, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return err
+	}
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 0x01 {
+		return bp.cmdError("error reading leave bitbang mode reply, n: %d, %w", n, replyErr(n, err))
+	}
+	bp.mode = ModeText
+	return nil
+}
+
+// clearModeState forgets the settings stored for the protocol mode left.
+func (bp *BusPirate) clearModeState() {
+	bp.periph = 0
+	bp.spiSpeed, bp.spiCfg, bp.spiCS = 0, 0, 0
+	bp.spiCSPin = 0
+	bp.i2cSpeed = 0
+	bp.uartSpeed, bp.uartCfg = 0, 0
+}
+
+// ErrTimeout is returned, wrapped in the command's error, when the device
+// doesn't take a command or reply to it within the timeout.
+var ErrTimeout = errors.New("error, timed out waiting for the device")
+
+// ErrUnsupported is returned for a feature the connected board or its
+// firmware doesn't support.
+var ErrUnsupported = errors.New("error, not supported by the device")
+
+// defaultCmdTimeout bounds a reply read in every mode that has no timeout
+// set with WithModeTimeout.
+const defaultCmdTimeout = 2 * time.Second
+
+// cmdTimeout returns the reply read timeout of the current mode.
+func (bp *BusPirate) cmdTimeout() time.Duration {
+	if d, ok := bp.modeTimeouts[bp.mode]; ok {
+		return d
+	}
+	return defaultCmdTimeout
+}
+
+// timeoutErr returns err, or ErrTimeout for a blocking read or write that
+// transferred nothing without an error.
+func timeoutErr(n int, err error) error {
+	if err == nil && n == 0 {
+		return ErrTimeout
+	}
+	return err
+}
+
+// errInvalidReply stands in for the port error when a reply came in time
+// but isn't the one expected.
+var errInvalidReply = errors.New("invalid reply")
+
+// replyErr is timeoutErr for a reply that's checked as well as read: a
+// read that neither failed nor timed out got the wrong reply.
+func replyErr(n int, err error) error {
+	if err = timeoutErr(n, err); err == nil {
+		return errInvalidReply
+	}
+	return err
+}
+
 // PowerOn turns on the 5v and 3v3 regulators.
 func (bp *BusPirate) PowerOn() error {
+	return bp.PowerOnTimeout(bp.cmdTimeout())
+}
+
+// PowerOnTimeout is PowerOn bounding the command write and the reply read by
+// timeout. ErrTimeout is returned if the device doesn't reply in time.
+func (bp *BusPirate) PowerOnTimeout(timeout time.Duration) error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
 	buf := []byte{0xC0}
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error turning power on, n: %d, %v", n, err)
+	if n, err := bp.write(buf, timeout); n == 0 || err != nil {
+		return bp.cmdError("error turning power on, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
+	if err := bp.drain(); err != nil {
 		return err
 	}
-	if n, err := bp.BlockingRead(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error turning power on reply, n: %d, %v", n, err)
+	if n, err := bp.read(buf, timeout); n == 0 || err != nil {
+		return bp.cmdError("error turning power on reply, n: %d, %w", n, timeoutErr(n, err))
 	}
+	bp.pinSet = 0xC0
 	return nil
 }
 
 // PowerOff turns off the 5v and 3v3 regulators.
 func (bp *BusPirate) PowerOff() error {
+	return bp.PowerOffTimeout(bp.cmdTimeout())
+}
+
+// PowerOffTimeout is PowerOff bounding the command write and the reply read
+// by timeout. ErrTimeout is returned if the device doesn't reply in time.
+func (bp *BusPirate) PowerOffTimeout(timeout time.Duration) error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
 	buf := []byte{0x80}
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error turning power off, n: %d, %v", n, err)
+	if n, err := bp.write(buf, timeout); n == 0 || err != nil {
+		return bp.cmdError("error turning power off, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
+	if err := bp.drain(); err != nil {
 		return err
 	}
-	if n, err := bp.BlockingRead(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error turning power off reply, n: %d, %v", n, err)
+	if n, err := bp.read(buf, timeout); n == 0 || err != nil {
+		return bp.cmdError("error turning power off reply, n: %d, %w", n, timeoutErr(n, err))
 	}
+	bp.pinSet = 0x80
 	return nil
 }
 
 // SetPWM enables PWM output on the AUX pin with the specified duty cycle.
 // duty is clamped between [0, 1].
 func (bp *BusPirate) SetPWM(duty float64) error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
 	clamp(&duty, 0.0, 1.0)
 	PRy := uint16(0x3e7f)
-	OCR := uint16(float64(PRy) * duty)
-	buf := []byte{0x12, 0x00, uint8(OCR >> 8), uint8(OCR), uint8(PRy >> 8), uint8(PRy)}
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error setting pwm, n: %d, %v", n, err)
+	return bp.setPWM(0x00, uint16(float64(PRy)*duty), PRy)
+}
+
+// SetAuxFrequency outputs a square wave of about hz on the AUX pin, in
+// bitbang mode. The firmware has no separate frequency generator: this is
+// the PWM output at 50% duty, with the prescaler and period chosen for the
+// closest achievable frequency; PWMFrequency returns the frequency actually
+// set. hz is clamped to the PWM range, about 1Hz to 8MHz, and the
+// resolution coarsens towards the top of it, e.g. 4MHz and 8MHz are
+// neighbours. ClearPWM stops the output.
+func (bp *BusPirate) SetAuxFrequency(hz float64) error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
 	}
-	if err := bp.Drain(); err != nil {
+	clamp(&hz, pwmFcy/(256*65536.0), pwmFcy/2)
+	// the smallest prescaler whose period fits gives the finest steps
+	prescale := byte(0x00)
+	for prescale < 0x03 && pwmFcy/(pwmPrescaler(prescale)*hz) > 0x10000 {
+		prescale++
+	}
+	pr := math.Round(pwmFcy/(pwmPrescaler(prescale)*hz)) - 1
+	clamp(&pr, 1, 0xFFFF)
+	return bp.setPWM(prescale, uint16((pr+1)/2), uint16(pr))
+}
+
+// ClearPWM stops the PWM output on the AUX pin.
+func (bp *BusPirate) ClearPWM() error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
+	if err := bp.writeCfg(0x13, "clear pwm"); err != nil {
+		return err
+	}
+	bp.pwmPrescale, bp.pwmOCR, bp.pwmPRy = 0, 0, 0
+	return nil
+}
+
+// setPWM sends the PWM setup command, 0x12, with the timer prescale code,
+// duty cycle compare value and period.
+func (bp *BusPirate) setPWM(prescale byte, OCR, PRy uint16) error {
+	buf := []byte{0x12, prescale, uint8(OCR >> 8), uint8(OCR), uint8(PRy >> 8), uint8(PRy)}
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error setting pwm, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return err
+	}
+	if n, err := bp.read(buf[:1], bp.cmdTimeout()); n == 0 || err != nil {
+		return bp.cmdError("error setting pwm reply, n: %d, %w", n, timeoutErr(n, err))
+	}
+	bp.pwmPrescale, bp.pwmOCR, bp.pwmPRy = prescale, OCR, PRy
+	return nil
+}
+
+// pwmFcy is the PIC instruction clock driving the PWM timer.
+const pwmFcy = 16000000
+
+// PWMFrequency returns the frequency, in Hz, of the PWM output configured
+// by the last SetPWM, or 0 if PWM has not been set.
+func (bp *BusPirate) PWMFrequency() float64 {
+	if bp.pwmPRy == 0 {
+		return 0
+	}
+	return pwmFcy / (pwmPrescaler(bp.pwmPrescale) * (float64(bp.pwmPRy) + 1))
+}
+
+// GetPWM returns the PWM output on the AUX pin as last set through this
+// BusPirate: the duty cycle, between 0 and 1, the frequency in Hz, and
+// whether PWM is on; enabled is false if PWM was never set or has been
+// cleared. The firmware has no command to read the PWM registers back, so
+// a board set up by another session, or from text mode, reads as off, and
+// err is always nil.
+func (bp *BusPirate) GetPWM() (duty, freq float64, enabled bool, err error) {
+	if bp.pwmPRy == 0 {
+		return 0, 0, false, nil
+	}
+	// the output is high for OCR of the PRy+1 timer counts of a period
+	duty = float64(bp.pwmOCR) / (float64(bp.pwmPRy) + 1)
+	return math.Min(duty, 1), bp.PWMFrequency(), true, nil
+}
+
+// pwmPrescaler returns the timer divider for a PWM prescale setting.
+func pwmPrescaler(prescale byte) float64 {
+	switch prescale {
+	case 0x01:
+		return 8
+	case 0x02:
+		return 64
+	case 0x03:
+		return 256
+	}
+	return 1
+}
+
+// ReadVoltage takes a single ADC probe measurement, in bitbang mode, and
+// returns it in volts.
+func (bp *BusPirate) ReadVoltage() (float64, error) {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return 0, err
+	}
+	buf := []byte{adcRead, 0}
+	if n, err := bp.write(buf[:1], writeTimeout); n == 0 || err != nil {
+		return 0, bp.cmdError("error writing adc read, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return 0, err
+	}
+	if n, err := bp.readFull(buf, bp.cmdTimeout()); err != nil {
+		return 0, bp.cmdError("error reading adc read reply, n: %d, %w", n, err)
+	}
+	return adcVolts(buf), nil
+}
+
+// ReadVoltageStream starts continuous ADC probe measurements, in bitbang
+// mode, and sends each in volts on the returned channel until ctx is done.
+// The device streams readings as fast as it can; readings the receiver
+// doesn't keep up with are dropped. The channel is closed once the device
+// has stopped streaming, or on an I/O error; until then other commands fail
+// with ErrStreamActive.
+func (bp *BusPirate) ReadVoltageStream(ctx context.Context) (<-chan float64, error) {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return nil, err
+	}
+	if n, err := bp.write([]byte{adcStreamRead}, writeTimeout); n == 0 || err != nil {
+		return nil, bp.cmdError("error writing adc stream read, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return nil, err
+	}
+
+	bp.streaming.Store(true)
+	ch := make(chan float64)
+	go func() {
+		defer func() {
+			// any byte stops the stream; a binary reset is harmless in
+			// bitbang mode, and its reply is dropped with the last readings
+			bp.write([]byte{resetBitbangMode}, writeTimeout)
+			bp.drain()
+			bp.flushInput()
+			bp.streaming.Store(false)
+			close(ch)
+		}()
+		buf := make([]byte, 2)
+		for ctx.Err() == nil {
+			if _, err := bp.readFull(buf, bp.cmdTimeout()); err != nil {
+				return
+			}
+			select {
+			case ch <- adcVolts(buf):
+			case <-ctx.Done():
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// ADCChannels returns the number of analog inputs ReadADC can measure on
+// the connected board. Both v3 and v4 boards expose the one ADC probe
+// through the binary protocol.
+func (bp *BusPirate) ADCChannels() int {
+	return 1
+}
+
+// ReadADC takes a single measurement, in bitbang mode, from the analog
+// input channel and returns it in volts. Channel 0 is the ADC probe.
+func (bp *BusPirate) ReadADC(channel int) (float64, error) {
+	if channel < 0 || channel >= bp.ADCChannels() {
+		return 0, fmt.Errorf("error, invalid adc channel: %d, board has %d", channel, bp.ADCChannels())
+	}
+	return bp.ReadVoltage()
+}
+
+// ReadAuxVoltage would measure the voltage on the AUX pin. No released
+// firmware, v3 or v4, routes AUX to the ADC: the binary protocol measures
+// only the ADC probe, and the text-mode 'v' report shows AUX as a logic
+// level. It returns ErrUnsupported on every board, so that callers can
+// test for the capability; wire the point to the ADC probe and use
+// ReadVoltage instead.
+func (bp *BusPirate) ReadAuxVoltage() (float64, error) {
+	if err := bp.checkMode(binaryModes...); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%w: aux voltage measurement on a %s board", ErrUnsupported, bp.board)
+}
+
+// adcVolts converts the 10 bit big-endian ADC reading to volts. The probe
+// sits behind a 1/2 voltage divider and the ADC reference is 3.3v.
+func adcVolts(b []byte) float64 {
+	return float64(uint16(b[0])<<8|uint16(b[1])) / 1024 * 3.3 * 2
+}
+
+// bitbangReset sends the binary reset, returning to bitbang mode from any
+// protocol mode, and verifies the "BBIO1" reply.
+func (bp *BusPirate) bitbangReset() error {
+	if n, err := bp.write([]byte{resetBitbangMode}, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing bitbang reset, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
 		return err
 	}
-	if n, err := bp.BlockingRead(buf[:1], 2000); n == 0 || err != nil {
-		return fmt.Errorf("error setting pwm reply, n: %d, %v", n, err)
+	reply := make([]byte, 5)
+	if n, err := bp.readFull(reply, bp.cmdTimeout()); err != nil || string(reply) != "BBIO1" {
+		err = bp.cmdError("error reading bitbang reset reply, n: %d, %w", n, replyErr(n, err))
+		bp.flushInput()
+		return err
 	}
+	bp.mode = ModeBitbang
+	bp.pinDir, bp.pinSet = 0, 0
+	return nil
+}
+
+// pinCmd sends a bitbang pin direction or pin set command and returns the
+// pin state byte the device replies with.
+func (bp *BusPirate) pinCmd(cmd byte) (byte, error) {
+	buf := []byte{cmd}
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return 0, bp.cmdError("error writing pin command, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return 0, err
+	}
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil {
+		return 0, bp.cmdError("error reading pin command reply, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if cmd&0xE0 == bbPinDir {
+		bp.pinDir = cmd
+	}
+	if cmd&bbPinSet != 0 {
+		bp.pinSet = cmd
+	}
+	return buf[0], nil
+}
+
+// verifyPeriph checks the stored peripheral config against the pin state.
+// The protocol modes can't read the pins, so the device is dropped to
+// bitbang mode, where the same power, pullup, AUX and CS settings are
+// applied and read back, and reenter then returns it to the protocol mode.
+func (bp *BusPirate) verifyPeriph(reenter func() error) error {
+	want := byte(0)
+	if bp.periph&0x08 != 0 {
+		want |= pinPower
+	}
+	if bp.periph&0x04 != 0 {
+		want |= pinPullup
+	}
+	if bp.periph&0x02 != 0 {
+		want |= pinAUX
+	}
+	if bp.periph&0x01 != 0 {
+		want |= pinCS
+	}
+	if err := bp.bitbangReset(); err != nil {
+		return err
+	}
+	// AUX and CS are driven, the bus pins left as inputs
+	if _, err := bp.pinCmd(bbPinDir | pinMOSI | pinCLK | pinMISO); err != nil {
+		return err
+	}
+	state, err := bp.pinCmd(bbPinSet | want)
+	if err != nil {
+		return err
+	}
+	if err := reenter(); err != nil {
+		return err
+	}
+	mask := byte(pinPower | pinPullup | pinAUX | pinCS)
+	if state&mask != want {
+		return bp.cmdError("error, peripheral config not applied, requested 0x%02x, pin state 0x%02x", want, state&mask)
+	}
+	return nil
+}
+
+// writeCmd sends a single byte command and checks for the 0x01 reply.
+func (bp *BusPirate) writeCmd(cmd byte, what string) error {
+	buf := []byte{cmd}
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing %s, n: %d, %w", what, n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return err
+	}
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 0x01 {
+		return bp.cmdError("error reading %s reply, n: %d, %w", what, n, replyErr(n, err))
+	}
+	return nil
+}
+
+// writeCfg is writeCmd for configuration commands, which nothing else
+// follows, so WithStrictAcks can check for stray bytes.
+func (bp *BusPirate) writeCfg(cmd byte, what string) error {
+	if err := bp.writeCmd(cmd, what); err != nil {
+		return err
+	}
+	return bp.ackOnly(what)
+}
+
+// ErrUnexpectedReply is returned, with WithStrictAcks, when more bytes
+// follow a command's 0x01 reply.
+var ErrUnexpectedReply = errors.New("error, unexpected bytes after the reply")
+
+// strictAckWait is how long WithStrictAcks waits for stray bytes after a
+// reply; it covers a v3's FTDI latency timer at its default.
+const strictAckWait = 20 * time.Millisecond
+
+// ackOnly checks, with WithStrictAcks, that nothing followed the single
+// byte reply to the what command just read. The stray bytes are flushed.
+func (bp *BusPirate) ackOnly(what string) error {
+	if !bp.strictAcks {
+		return nil
+	}
+	buf := make([]byte, 16)
+	n, err := bp.read(buf, strictAckWait)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		err := bp.cmdError("error reading %s reply, %d more bytes, %w", what, n, ErrUnexpectedReply)
+		bp.flushInput()
+		return err
+	}
+	return nil
+}
+
+// SetAux drives the AUX pin high or low in a protocol mode (SPI, I2C)
+// through the peripheral config, preserving the power, pullup and CS bits
+// last set with SpiCfgPeriph or I2cCfgPeriph.
+func (bp *BusPirate) SetAux(high bool) error {
+	if err := bp.checkMode(ModeSpi, ModeI2c, ModeUart); err != nil {
+		return err
+	}
+	cmd := bp.periph
+	if cmd == 0 {
+		cmd = spiPeriphCfg
+	}
+	cmd &^= 0x02
+	if high {
+		cmd |= 0x02
+	}
+	if err := bp.writeCfg(cmd, "aux"); err != nil {
+		return err
+	}
+	bp.periph = cmd
 	return nil
 }
 
@@ -239,6 +1089,24 @@ func clamp(v *float64, lower, upper float64) {
 	}
 }
 
+const (
+	adcRead       = 0x14
+	adcStreamRead = 0x15
+	bbPinDir      = 0x40 // 010xxxxx, 1 = input: AUX|MOSI|CLK|MISO|CS
+	bbPinSet      = 0x80 // 1xxxxxxx, 1 = on: POWER|PULLUP|AUX|MOSI|CLK|MISO|CS
+)
+
+// bitbang pin bits, as used by the pin commands and their pin state replies
+const (
+	pinCS     = 0x01
+	pinMISO   = 0x02
+	pinCLK    = 0x04
+	pinMOSI   = 0x08
+	pinAUX    = 0x10
+	pinPullup = 0x20
+	pinPower  = 0x40
+)
+
 const (
 	resetBitbangMode    = 0x00
 	spiRawMode          = 0x01
@@ -251,54 +1119,135 @@ const (
 	spiWriteReadCmdNoCS = 0x05
 )
 
-// SpiEnter enters binary SPI mode.
+// SpiEnter enters binary SPI mode and deasserts chip select, unless Open
+// was given WithoutSpiCSDeassert.
 func (bp *BusPirate) SpiEnter() error {
-	if n, err := bp.BlockingWrite([]byte{spiRawMode}, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error writing enter spi mode, n: %d, %v", n, err)
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
 	}
-	if err := bp.Drain(); err != nil {
+	if n, err := bp.write([]byte{spiRawMode}, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing enter spi mode, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
 		return err
 	}
 	reply := make([]byte, 4)
-	if n, err := bp.BlockingRead(reply, 2000); err != nil || string(reply) != "SPI1" {
-		return fmt.Errorf("error reading enter spi mode, n: %d, %v", n, err)
+	if n, err := bp.readFull(reply, bp.cmdTimeout()); err != nil || string(reply) != "SPI1" {
+		err = bp.cmdError("error reading enter spi mode, n: %d, %w", n, replyErr(n, err))
+		bp.flushInput()
+		return err
 	}
-	return nil
+	bp.mode = ModeSpi
+	if bp.spiCSKeep {
+		return nil
+	}
+	// deselect the chip before anything else is configured
+	return bp.SpiCS(!bp.spiCSActiveHigh)
 }
 
 // SpiLeave exits SPI mode, returning to bitbang mode.
 func (bp *BusPirate) SpiLeave() error {
-	if n, err := bp.BlockingWrite([]byte{resetBitbangMode}, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error writing leave spi mode, n: %d, %v", n, err)
+	return bp.BitbangEnter()
+}
+
+// SpiReadVoltage measures the ADC probe during an SPI session. The SPI binary
+// protocol has no ADC command, so the device is dropped to bitbang mode for
+// the reading and SPI mode is then re-entered with the last applied speed,
+// configuration, peripheral and CS settings. The SPI pins are briefly reset
+// during the round trip.
+func (bp *BusPirate) SpiReadVoltage() (float64, error) {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return 0, err
+	}
+	if err := bp.bitbangReset(); err != nil {
+		return 0, err
+	}
+	v, err := bp.ReadVoltage()
+	if err != nil {
+		return 0, err
+	}
+	return v, bp.spiReenter()
+}
+
+// spiReenter re-enters SPI mode after a round trip through bitbang mode and
+// re-issues the stored settings. SpiEnter deasserts chip select, so the
+// chip select stored before is put back for spiRestore: a round trip within
+// a WithCS window has to leave the chip selected.
+func (bp *BusPirate) spiReenter() error {
+	cs := bp.spiCS
+	if err := bp.SpiEnter(); err != nil {
+		return err
+	}
+	if cs != 0 {
+		bp.spiCS = cs
+	}
+	return bp.spiRestore()
+}
+
+// spiRestore re-issues the stored SPI settings after SPI mode is re-entered.
+func (bp *BusPirate) spiRestore() error {
+	for _, cmd := range []byte{bp.spiSpeed, bp.spiCfg, bp.periph, bp.spiCS} {
+		if cmd == 0 {
+			continue
+		}
+		if err := bp.writeCfg(cmd, fmt.Sprintf("spi restore 0x%02x", cmd)); err != nil {
+			return err
+		}
 	}
-	bp.Drain()
 	return nil
 }
 
 // SpiCS sets the chip select state.
 // high = true, low = false
 func (bp *BusPirate) SpiCS(high bool) error {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return err
+	}
 	// 00000010 – CS low (0)
 	// 00000011 – CS high (1)
 	buf := []byte{spiCSState}
 	if high {
 		buf[0] |= 0x01
 	}
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error writing set spi cs, n: %d, %v", n, err)
+	cmd := buf[0]
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing set spi cs, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
+	if err := bp.drain(); err != nil {
 		return err
 	}
-	if n, err := bp.BlockingRead(buf, 2000); n == 0 || err != nil || buf[0] != 0x01 {
-		return fmt.Errorf("error reading set spi cs reply, n: %d, %v", n, err)
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 0x01 {
+		return bp.cmdError("error reading set spi cs reply, n: %d, %w", n, replyErr(n, err))
+	}
+	if err := bp.ackOnly("set spi cs"); err != nil {
+		return err
 	}
+	bp.spiCS = cmd
 	return nil
 }
 
+// WithCS asserts chip select (low, or high if Open was given
+// WithSpiCSActiveHigh), runs fn and deasserts chip select, even when fn
+// fails. fn may issue any number of transfers, all of which happen within
+// the one chip select window. The chip select is the pin set with
+// SpiSetCSPin.
+func (bp *BusPirate) WithCS(fn func() error) error {
+	if err := bp.SpiSelect(); err != nil {
+		return err
+	}
+	err := fn()
+	if csErr := bp.SpiDeselect(); err == nil {
+		err = csErr
+	}
+	return err
+}
+
 // SpiCfgPeriph configures the spi peripherals.
 // 0100wxyz – Configure peripherals, w=power, x=pullups, y=AUX, z=CS
 func (bp *BusPirate) SpiCfgPeriph(power, pullups, aux, cs bool) error {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return err
+	}
 	buf := []byte{spiPeriphCfg}
 	if power {
 		buf[0] |= 0x08
@@ -312,14 +1261,22 @@ func (bp *BusPirate) SpiCfgPeriph(power, pullups, aux, cs bool) error {
 	if cs {
 		buf[0] |= 0x01
 	}
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error writing spi periph cfg, n: %d, %v", n, err)
+	cmd := buf[0]
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing spi periph cfg, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
+	if err := bp.drain(); err != nil {
 		return err
 	}
-	if n, err := bp.BlockingRead(buf, 2000); n == 0 || err != nil || buf[0] != 0x01 {
-		return fmt.Errorf("error reading spi periph cfg reply, n: %d, %v", n, err)
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 0x01 {
+		return bp.cmdError("error reading spi periph cfg reply, n: %d, %w", n, replyErr(n, err))
+	}
+	if err := bp.ackOnly("spi periph cfg"); err != nil {
+		return err
+	}
+	bp.periph = cmd
+	if bp.periphVerify {
+		return bp.verifyPeriph(bp.spiReenter)
 	}
 	return nil
 }
@@ -339,19 +1296,52 @@ const (
 	SpiSpeed8mhz
 )
 
+var spiSpeedHz = [...]int{30000, 125000, 250000, 1000000, 2000000, 2600000, 4000000, 8000000}
+
+// Hz returns the SPI clock frequency of the speed setting, or 0 for an
+// invalid setting.
+func (s SpiSpeed) Hz() int {
+	if int(s) >= len(spiSpeedHz) {
+		return 0
+	}
+	return spiSpeedHz[s]
+}
+
+// NearestSpiSpeed returns the fastest SPI speed that doesn't exceed hz,
+// rounding down so a device's maximum clock is never exceeded, e.g. 3MHz
+// gives SpiSpeed2600khz. hz below 30kHz, the slowest speed, gives
+// SpiSpeed30khz.
+func NearestSpiSpeed(hz int) SpiSpeed {
+	s := SpiSpeed30khz
+	for i, f := range spiSpeedHz {
+		if f <= hz {
+			s = SpiSpeed(i)
+		}
+	}
+	return s
+}
+
 // SpiSpeed sets SPI bus speed.
 func (bp *BusPirate) SpiSpeed(speed SpiSpeed) error {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return err
+	}
 	buf := []byte{spiSpeedCfg}
 	buf[0] |= byte(speed & 0x07)
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error writing spi speed, n: %d, %v", n, err)
+	cmd := buf[0]
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing spi speed, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
+	if err := bp.drain(); err != nil {
 		return err
 	}
-	if n, err := bp.BlockingRead(buf, 2000); n == 0 || err != nil || buf[0] != 0x01 {
-		return fmt.Errorf("error reading spi speed reply, n: %d, %v", n, err)
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 0x01 {
+		return bp.cmdError("error reading spi speed reply, n: %d, %w", n, replyErr(n, err))
 	}
+	if err := bp.ackOnly("spi speed"); err != nil {
+		return err
+	}
+	bp.spiSpeed = cmd
 	return nil
 }
 
@@ -363,6 +1353,9 @@ func (bp *BusPirate) SpiSpeed(speed SpiSpeed) error {
 // y=CKE clock edge (active to idle=1)
 // z=SMP sample time (middle=0)
 func (bp *BusPirate) SpiCfg(output33v, idle, edge, sample bool) error {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return err
+	}
 	buf := []byte{spiCfg}
 	if output33v {
 		buf[0] |= 0x08
@@ -376,56 +1369,347 @@ func (bp *BusPirate) SpiCfg(output33v, idle, edge, sample bool) error {
 	if sample {
 		buf[0] |= 0x01
 	}
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error writing spi cfg, n: %d, %v", n, err)
+	cmd := buf[0]
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing spi cfg, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
+	if err := bp.drain(); err != nil {
 		return err
 	}
-	if n, err := bp.BlockingRead(buf, 2000); n == 0 || err != nil || buf[0] != 0x01 {
-		return fmt.Errorf("error reading spi cfg reply, n: %d, %v", n, err)
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 0x01 {
+		return bp.cmdError("error reading spi cfg reply, n: %d, %w", n, replyErr(n, err))
 	}
+	if err := bp.ackOnly("spi cfg"); err != nil {
+		return err
+	}
+	bp.spiCfg = cmd
 	return nil
 }
 
+// ErrSpiCSDeasserted is returned by SpiSend, when Open was given
+// WithSpiStrictCS, if chip select isn't asserted.
+var ErrSpiCSDeasserted = errors.New("error, spi chip select is not asserted")
+
+// spiCSAsserted reports whether chip select was last set to its active level.
+func (bp *BusPirate) spiCSAsserted() bool {
+	if bp.spiCSPin == PinAUX {
+		return bp.periph != 0 && (bp.periph&0x02 != 0) == bp.spiCSActiveHigh
+	}
+	if bp.spiCS == 0 {
+		return false
+	}
+	return (bp.spiCS&0x01 != 0) == bp.spiCSActiveHigh
+}
+
 // SpiSend sends from 1 to 16 bytes to the SPI device. Reads a byte
-// for each byte sent.
+// for each byte sent. SpiSend doesn't touch chip select; see SpiCS and
+// WithCS.
 func (bp *BusPirate) SpiSend(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	if err := bp.SpiSendInto(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SpiSendInto is SpiSend reading the bytes clocked in into out, which must
+// be at least as long as data, rather than into a new slice, for polling
+// loops that would otherwise allocate on every call.
+func (bp *BusPirate) SpiSendInto(data, out []byte) error {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return err
+	}
 	// send cmd and read reply
 	// send 1 - 16 bytes reading a reply byte after each send
 	l := len(data)
 	if l < 1 || l > 16 {
-		return nil, fmt.Errorf("error, spi send length must be between 1 and 16 bytes")
+		return fmt.Errorf("error, spi send length must be between 1 and 16 bytes")
+	}
+	if len(out) < l {
+		return fmt.Errorf("error, spi send out buffer too short, %d bytes for %d", len(out), l)
+	}
+	if bp.spiStrictCS && !bp.spiCSAsserted() {
+		return ErrSpiCSDeasserted
 	}
 
 	buf := []byte{spiBulkTransferMode | byte(l-1)}
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return nil, fmt.Errorf("error writing bulk transfer mode, n: %d, %v", n, err)
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing bulk transfer mode, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
-		return nil, err
+	if err := bp.drain(); err != nil {
+		return err
 	}
-	if n, err := bp.BlockingRead(buf, 2000); n == 0 || err != nil || buf[0] != 0x01 {
-		return nil, fmt.Errorf("error reading bulk transfer mode reply, n: %d, %v", n, err)
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 0x01 {
+		return bp.cmdError("error reading bulk transfer mode reply, n: %d, %w", n, replyErr(n, err))
 	}
 
-	out := make([]byte, l)
 	for i := 0; i < l; i++ {
-		if n, err := bp.BlockingWrite(data[i:i+1], 2000); n == 0 || err != nil {
-			return nil, fmt.Errorf("error writing bulk transfer data, n: %d, %v", n, err)
+		if n, err := bp.write(data[i:i+1], writeTimeout); n == 0 || err != nil {
+			return bp.cmdError("error writing bulk transfer data, n: %d, %w", n, timeoutErr(n, err))
+		}
+		if err := bp.drain(); err != nil {
+			return err
+		}
+		if n, err := bp.read(out[i:i+1], bp.cmdTimeout()); n == 0 || err != nil {
+			return bp.cmdError("error reading bulk transfer data reply, n: %d, %w", n, timeoutErr(n, err))
+		}
+	}
+	return nil
+}
+
+// SpiDuplex clocks data out on MOSI and returns the bytes clocked in on
+// MISO at the same time, one for each byte sent: in[i] is what the device
+// sent while data[i] went out, which is how SPI itself works. Write then
+// read commands, which SpiWriteRead uses, send and only then read, so
+// SpiDuplex uses bulk transfers, 16 bytes at a time. Any length is
+// accepted, but each bulk transfer costs a USB round trip per byte.
+//
+// With cs set, chip select is asserted around the whole exchange as by
+// WithCS; otherwise chip select is left to the caller.
+func (bp *BusPirate) SpiDuplex(data []byte, cs bool) ([]byte, error) {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return nil, err
+	}
+	in := make([]byte, len(data))
+	xfer := func() error {
+		return bp.spiDuplexInto(data, in)
+	}
+	var err error
+	if cs {
+		err = bp.WithCS(xfer)
+	} else {
+		err = xfer()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// spiDuplexInto is SpiDuplex reading into in, which is as long as data,
+// leaving chip select alone.
+func (bp *BusPirate) spiDuplexInto(data, in []byte) error {
+	for off := 0; off < len(data); off += 16 {
+		end := off + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := bp.SpiSendInto(data[off:end], in[off:end]); err != nil {
+			return err
 		}
-		if err := bp.Drain(); err != nil {
+	}
+	return nil
+}
+
+// SpiRead reads n bytes within one chip select, clocking out the fill
+// byte, 0xFF unless set with WithSpiFillByte, while it reads.
+func (bp *BusPirate) SpiRead(n int) ([]byte, error) {
+	return bp.spiReadAfter(nil, n)
+}
+
+// SpiReadRegister writes the register address reg and reads n bytes from
+// it within one chip select, clocking out the fill byte as for SpiRead,
+// the usual register read of SPI sensors and peripherals. Devices that
+// flag reads in the address, e.g. with its top bit, need it set in reg.
+func (bp *BusPirate) SpiReadRegister(reg byte, n int) ([]byte, error) {
+	return bp.spiReadAfter([]byte{reg}, n)
+}
+
+// spiReadAfter writes prefix and reads n bytes, clocking out the fill byte.
+// The write then read command clocks out 0xFF while reading, so other fill
+// bytes are sent with bulk transfers, a USB round trip per byte, within an
+// explicitly asserted chip select.
+func (bp *BusPirate) spiReadAfter(prefix []byte, n int) ([]byte, error) {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("error, invalid spi read length: %d", n)
+	}
+	in := make([]byte, n)
+	if bp.spiFill == 0xFF {
+		if err := bp.SpiWriteRead(prefix, in); err != nil {
 			return nil, err
 		}
-		if n, err := bp.BlockingRead(out[i:i+1], 2000); n == 0 || err != nil {
-			return nil, fmt.Errorf("error reading bulk transfer data reply, n: %d, %v", n, err)
+		return in, nil
+	}
+	err := bp.WithCS(func() error {
+		if len(prefix) > 0 {
+			if _, err := bp.SpiDuplex(prefix, false); err != nil {
+				return err
+			}
 		}
+		got, err := bp.SpiDuplex(bytes.Repeat([]byte{bp.spiFill}, n), false)
+		copy(in, got)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return out, nil
+	return in, nil
+}
+
+// SpiClockPulses deasserts chip select and clocks n cycles with MOSI held
+// high, as SD cards need (at least 74 cycles) before they answer in SPI
+// mode. The hardware clocks whole bytes, so n is rounded up to a multiple
+// of 8; the cycles are 0xFF bytes sent with the no-CS write command, so CS
+// stays deasserted throughout, whatever WithSpiFillByte sets.
+func (bp *BusPirate) SpiClockPulses(n int) error {
+	if n < 1 {
+		return fmt.Errorf("error, spi clock pulses must be at least 1, got %d", n)
+	}
+	if err := bp.SpiDeselect(); err != nil {
+		return err
+	}
+	for l := (n + 7) / 8; l > 0; {
+		c := l
+		if c > 4096 {
+			c = 4096
+		}
+		if _, err := bp.SpiWriteReadNoCS(bytes.Repeat([]byte{0xFF}, c), 0); err != nil {
+			return err
+		}
+		l -= c
+	}
+	return nil
+}
+
+// spiLoopbackPattern exercises every bit in both levels and transitions.
+var spiLoopbackPattern = []byte{
+	0x55, 0xAA, 0x00, 0xFF, 0x01, 0x02, 0x04, 0x08,
+	0x10, 0x20, 0x40, 0x80, 0xFE, 0x7F, 0xA5, 0x5A,
 }
 
-// SpiWriteRead writes 0-4096 bytes and/or reads 0-4096 bytes.
+// SpiLoopbackTest checks the SPI path end to end with MOSI jumpered to
+// MISO and no target attached: a known pattern is sent and must read back
+// unchanged. A mismatch error shows the bytes sent and received.
+func (bp *BusPirate) SpiLoopbackTest() error {
+	r, err := bp.SpiSend(spiLoopbackPattern)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(r, spiLoopbackPattern) {
+		return fmt.Errorf("error, spi loopback mismatch, sent: % x, received: % x", spiLoopbackPattern, r)
+	}
+	return nil
+}
+
+// ReverseBits returns b with its bit order reversed, converting between the
+// MSB-first order the Bus Pirate clocks SPI data in and the LSB-first order
+// some devices expect.
+func ReverseBits(b byte) byte {
+	return bits.Reverse8(b)
+}
+
+// ReverseBitsSlice returns a copy of data with the bit order of each byte
+// reversed. Apply it to the data sent to, and the data read from, an
+// LSB-first device.
+func ReverseBitsSlice(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = bits.Reverse8(b)
+	}
+	return out
+}
+
+// SpiWriteRead writes and/or reads any number of bytes in one chip select
+// window. The write then read command asserts chip select itself, driving
+// it low and clocking the first bit right after; for devices that need
+// more CS setup or hold time than that, see WithSpiCSSettle. With
+// WithSpiCSActiveHigh, chip select is asserted with explicit commands
+// instead, as for a long transfer. Transfers larger than the chunk
+// size, 4096 bytes, the command's limit, unless set with WithSpiChunkSize,
+// are split into several commands within an explicitly asserted chip
+// select.
 func (bp *BusPirate) SpiWriteRead(outData, inData []byte) error {
+	return bp.SpiWriteReadContext(context.Background(), outData, inData)
+}
+
+// SpiWriteReadContext is SpiWriteRead bounding the in-data read by ctx: it
+// fails with ErrTimeout once the ctx deadline passes, or with the ctx error
+// if ctx is cancelled, rather than the default of the transfer time at the
+// current speed plus a second. The in-data still in flight is discarded.
+// A chunked transfer also stops between chunks once ctx is done.
+func (bp *BusPirate) SpiWriteReadContext(ctx context.Context, outData, inData []byte) error {
+	chunk := bp.spiChunk
+	if chunk == 0 {
+		chunk = 4096
+	}
+	if bp.spiCSSettle == 0 && bp.spiCSPin != PinAUX && !bp.spiCSActiveHigh && len(outData) <= chunk && len(inData) <= chunk {
+		return bp.spiWriteRead(ctx, spiWriteReadCmd, outData, inData)
+	}
+	// the 0x04 command can't be told to wait, to keep chip select asserted
+	// across commands, to use another pin, or to select the chip by driving
+	// CS high, so frame the no-CS 0x05 with explicit chip select commands
+	return bp.WithCS(func() error {
+		time.Sleep(bp.spiCSSettle)
+		err := bp.spiWriteReadChunked(ctx, chunk, outData, inData)
+		time.Sleep(bp.spiCSSettle)
+		return err
+	})
+}
+
+// spiWriteReadChunked writes outData and then reads inData with no-CS
+// write then read commands of at most chunk bytes each.
+func (bp *BusPirate) spiWriteReadChunked(ctx context.Context, chunk int, outData, inData []byte) error {
+	if len(outData) <= chunk && len(inData) <= chunk {
+		return bp.spiWriteRead(ctx, spiWriteReadCmdNoCS, outData, inData)
+	}
+	for off := 0; off < len(outData); off += chunk {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := off + chunk
+		if end > len(outData) {
+			end = len(outData)
+		}
+		if err := bp.spiWriteRead(ctx, spiWriteReadCmdNoCS, outData[off:end], nil); err != nil {
+			return err
+		}
+	}
+	for off := 0; off < len(inData); off += chunk {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := off + chunk
+		if end > len(inData) {
+			end = len(inData)
+		}
+		if err := bp.spiWriteRead(ctx, spiWriteReadCmdNoCS, nil, inData[off:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SpiWriteReadNoCS writes 0-4096 bytes and then reads readLen (0-4096)
+// bytes like SpiWriteRead, but without touching chip select, for chips
+// selected by other means, e.g. SpiCS or an external GPIO.
+func (bp *BusPirate) SpiWriteReadNoCS(outData []byte, readLen int) ([]byte, error) {
+	if readLen < 0 || readLen > 4096 {
+		return nil, fmt.Errorf("error, spi read/write in-data count (0-4096 bytes)")
+	}
+	inData := make([]byte, readLen)
+	if err := bp.spiWriteRead(context.Background(), spiWriteReadCmdNoCS, outData, inData); err != nil {
+		return nil, err
+	}
+	return inData, nil
+}
+
+// spiReadTimeout is how long the in-data of a write then read may take to
+// arrive: the clocking time of the n bytes written and read at the speed
+// last set, 30kHz if none has been, plus a second for the USB round trip.
+func (bp *BusPirate) spiReadTimeout(n int) time.Duration {
+	hz := SpiSpeed(bp.spiSpeed & 0x07).Hz()
+	return time.Second + time.Duration(n*8)*time.Second/time.Duration(hz)
+}
+
+// spiWriteRead runs a write then read command, cmd being the CS managing
+// 0x04 or the no-CS 0x05.
+func (bp *BusPirate) spiWriteRead(ctx context.Context, cmd byte, outData, inData []byte) error {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return err
+	}
 	// write send count
 	// write receive count
 	// write out-data if any
@@ -442,47 +1726,72 @@ func (bp *BusPirate) SpiWriteRead(outData, inData []byte) error {
 	}
 
 	// send the ReadWrite command
-	buf := []byte{spiWriteReadCmd, 0}
-	if n, err := bp.BlockingWrite(buf[:1], 2000); n == 0 || err != nil {
-		return fmt.Errorf("error, spi read/write in-data count (0-4096 bytes)")
+	buf := []byte{cmd, 0}
+	if n, err := bp.write(buf[:1], writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing spi write/read command, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
+	if err := bp.drain(); err != nil {
 		return err
 	}
 
 	// out data count
 	buf[1] = byte(outCnt)
 	buf[0] = byte(outCnt >> 8)
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error writing out-data count, n: %d, %v", n, err)
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing out-data count, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
+	if err := bp.drain(); err != nil {
 		return err
 	}
 	// in data count
 	buf[1] = byte(inCnt)
 	buf[0] = byte(inCnt >> 8)
-	if n, err := bp.BlockingWrite(buf, 2000); n == 0 || err != nil {
-		return fmt.Errorf("error writing in-data count, n: %d, %v", n, err)
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing in-data count, n: %d, %w", n, timeoutErr(n, err))
 	}
-	if err := bp.Drain(); err != nil {
+	if err := bp.drain(); err != nil {
 		return err
 	}
-	if n, err := bp.Write(outData); n == 0 || err != nil {
-		return fmt.Errorf("error writing out-data, n: %d, %v", n, err)
-	}
-	if err := bp.Drain(); err != nil {
-		return err
+	if outCnt > 0 {
+		if n, err := bp.write(outData, writeTimeout); n < outCnt || err != nil {
+			if err == nil {
+				err = ErrTimeout
+			}
+			return bp.cmdError("error writing out-data, n: %d, %w", n, err)
+		}
+		if err := bp.drain(); err != nil {
+			return err
+		}
 	}
 	// check status
-	if n, err := bp.BlockingRead(buf[:1], 2000); n == 0 || err != nil || buf[0] != 1 {
-		return fmt.Errorf("error out/in data status, n: %d, %v", n, err)
+	if n, err := bp.read(buf[:1], bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 1 {
+		return bp.cmdError("error out/in data status, n: %d, %w", n, replyErr(n, err))
 	}
 	// in data
 	if inCnt > 0 {
-		// TODO: proper time for make 4096 bits
-		if n, err := bp.BlockingRead(inData, 60*1000); n < inCnt || err != nil {
-			return fmt.Errorf("errorreading in-data, n: %d, %v", n, err)
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(bp.spiReadTimeout(outCnt + inCnt))
+		}
+		// read in short slices so cancellation is noticed promptly
+		for got := 0; got < inCnt; {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				bp.discardInput()
+				return bp.cmdError("error reading in-data, n: %d, %w", got, ErrTimeout)
+			}
+			if err := ctx.Err(); err != nil {
+				bp.discardInput()
+				return bp.cmdError("error reading in-data, n: %d, %w", got, err)
+			}
+			if wait > 100*time.Millisecond {
+				wait = 100 * time.Millisecond
+			}
+			n, err := bp.read(inData[got:], wait)
+			if err != nil {
+				return bp.cmdError("error reading in-data, n: %d, %w", got, err)
+			}
+			got += n
 		}
 	}
 
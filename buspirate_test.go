@@ -0,0 +1,380 @@
+package buspirate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIndependentInstances(t *testing.T) {
+	fakes := []*fakePort{newFakePort(), newFakePort()}
+	bps := make([]*BusPirate, len(fakes))
+	for i, f := range fakes {
+		id := byte(0xA0 + i)
+		f.target = func(byte) byte { return id }
+		bp, err := open(f, 115200, nil)
+		if err != nil {
+			t.Fatalf("open %d: %v", i, err)
+		}
+		bps[i] = bp
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(bps))
+	for i, bp := range bps {
+		wg.Add(1)
+		go func(i int, bp *BusPirate) {
+			defer wg.Done()
+			errs[i] = func() error {
+				if err := bp.SpiEnter(); err != nil {
+					return err
+				}
+				speed := SpiSpeed(i + 1)
+				for n := 0; n < 20; n++ {
+					if err := bp.SpiSpeed(speed); err != nil {
+						return err
+					}
+					in := make([]byte, 8)
+					if err := bp.SpiWriteRead([]byte{byte(i), byte(n)}, in); err != nil {
+						return err
+					}
+					if want := bytes.Repeat([]byte{byte(0xA0 + i)}, 8); !bytes.Equal(in, want) {
+						return fmt.Errorf("read % x, want % x", in, want)
+					}
+					if got := SpiSpeed(bp.spiSpeed & 0x07); got != speed {
+						return fmt.Errorf("speed %d, want %d", got, speed)
+					}
+				}
+				return nil
+			}()
+		}(i, bp)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("instance %d: %v", i, err)
+		}
+	}
+	for i, f := range fakes {
+		// every out-data first byte sent to a fake is its own index
+		w := f.sent()
+		for j := 0; j+6 < len(w); j++ {
+			if w[j] == spiWriteReadCmd && w[j+1] == 0 && w[j+2] == 2 && w[j+5] != byte(i) {
+				t.Errorf("fake %d got instance %d's data", i, w[j+5])
+			}
+		}
+	}
+}
+
+func TestModeEntryRetry(t *testing.T) {
+	f := newFakePort()
+	bp := fakeBitbang(t, f)
+	// a stray byte ahead of the reply, so "SPI1" reads as "\xffSPI"
+	f.once = map[byte][]byte{spiRawMode: []byte("\xffSPI1")}
+	if err := bp.SpiEnter(); err == nil {
+		t.Fatal("SpiEnter verified a bad reply")
+	}
+	// the device did enter SPI mode, where 0x01 answers "SPI1" again;
+	// without the flush, the retry would read the "1" left over
+	if err := bp.SpiEnter(); err != nil {
+		t.Fatalf("SpiEnter retry: %v", err)
+	}
+}
+
+func TestStrictAcksBleed(t *testing.T) {
+	speed := byte(spiSpeedCfg | SpiSpeed1mhz)
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict %v", strict), func(t *testing.T) {
+			var opts []Option
+			if strict {
+				opts = append(opts, WithStrictAcks())
+			}
+			f := newFakePort()
+			bp := fakeSpi(t, f, opts...)
+			// a late ack from an earlier command follows the speed ack
+			f.once = map[byte][]byte{speed: {0x01, 0x01}}
+			err := bp.SpiSpeed(SpiSpeed1mhz)
+			if strict {
+				if !errors.Is(err, ErrUnexpectedReply) {
+					t.Fatalf("SpiSpeed: %v, want ErrUnexpectedReply", err)
+				}
+			} else if err != nil {
+				t.Fatalf("SpiSpeed: %v", err)
+			}
+			// the stray 0x01 was dropped in strict mode; otherwise it's
+			// read as the start of the next reply
+			err = bp.Ping()
+			if strict && err != nil {
+				t.Fatalf("Ping after the stray ack was dropped: %v", err)
+			}
+			if !strict && err == nil {
+				t.Fatal("Ping read its reply past the stray ack")
+			}
+		})
+	}
+}
+
+func TestSpiWriteReadNoCS(t *testing.T) {
+	f := newFakePort()
+	bp := fakeSpi(t, f)
+	in, err := bp.SpiWriteReadNoCS([]byte{0x9F, 0x00}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(in) != 3 {
+		t.Fatalf("read %d bytes, want 3", len(in))
+	}
+	want := []byte{spiWriteReadCmdNoCS, 0x00, 0x02, 0x00, 0x03, 0x9F, 0x00}
+	if got := f.sent(); !bytes.Equal(got, want) {
+		t.Fatalf("wrote % x, want % x", got, want)
+	}
+	if len(f.csLog) != 0 {
+		t.Fatalf("chip select changed: %v", f.csLog)
+	}
+}
+
+func TestBinaryModePreamble(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		menus    int
+		preamble int
+		delay    time.Duration
+		ok       bool
+	}{
+		{"top-level prompt", 0, 10, 0, true},
+		{"sub-menu", 3, 10, 0, true},
+		{"sub-menu without preamble", 3, 0, 0, false},
+		{"late banner", 0, 10, 25 * time.Millisecond, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			f.menus = tc.menus
+			f.delay = tc.delay
+			bp := newBusPirate(f, []Option{WithPreambleNewlines(tc.preamble)})
+			err := bp.enterBinaryMode()
+			if (err == nil) != tc.ok {
+				t.Fatalf("enterBinaryMode: %v, want success %v", err, tc.ok)
+			}
+			if !tc.ok {
+				return
+			}
+			if bp.mode != ModeBitbang {
+				t.Fatalf("mode %v, want bitbang", bp.mode)
+			}
+			w := f.sent()
+			want := bytes.Repeat([]byte{'\n'}, tc.preamble)
+			if !bytes.HasPrefix(w, want) {
+				t.Fatalf("wrote % x, want %d newlines first", w, tc.preamble)
+			}
+			zeros := w[len(want):]
+			if len(zeros) < 20 || len(bytes.Trim(zeros, "\x00")) != 0 {
+				t.Fatalf("wrote % x after the preamble, want at least 20 0x00s", zeros)
+			}
+		})
+	}
+}
+
+func TestSpiWriteReadCSActiveHigh(t *testing.T) {
+	f := newFakePort()
+	bp := fakeSpi(t, f, WithSpiCSActiveHigh())
+	if err := bp.SpiWriteRead([]byte{0x9F}, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// CS high, the no-CS command, CS low
+	want := []byte{0x03, spiWriteReadCmdNoCS, 0x00, 0x01, 0x00, 0x02, 0x9F, 0x02}
+	if got := f.sent(); !bytes.Equal(got, want) {
+		t.Fatalf("wrote % x, want % x", got, want)
+	}
+}
+
+func TestPeriphVerifyKeepsCS(t *testing.T) {
+	f := newFakePort()
+	bp := fakeSpi(t, f, WithPeriphVerify())
+	err := bp.WithCS(func() error {
+		if err := bp.SpiCfgPeriph(true, false, false, true); err != nil {
+			return err
+		}
+		if !bp.spiCSAsserted() {
+			t.Error("chip select deasserted by the read back")
+		}
+		if cs := f.csLog[len(f.csLog)-1]; cs {
+			t.Error("chip select left high on the device after the read back")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpiReadVoltageKeepsCS(t *testing.T) {
+	f := newFakePort()
+	bp := fakeSpi(t, f)
+	err := bp.WithCS(func() error {
+		if _, err := bp.SpiReadVoltage(); err != nil {
+			return err
+		}
+		if cs := f.csLog[len(f.csLog)-1]; cs || !bp.spiCSAsserted() {
+			t.Error("chip select deasserted by the voltage read")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigSpiCSPin(t *testing.T) {
+	f := newFakePort()
+	bp := fakeSpi(t, f)
+	if err := bp.SpiCfgPeriph(true, true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bp.SpiSetCSPin(PinAUX); err != nil {
+		t.Fatal(err)
+	}
+	c := bp.SaveConfig()
+	f.sent()
+	if err := bp.RestoreConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if bp.spiCSPin != PinAUX {
+		t.Fatalf("chip select pin %v after RestoreConfig, want AUX", bp.spiCSPin)
+	}
+	if bp.periph != c.Periph {
+		t.Fatalf("periph 0x%02x after RestoreConfig, want 0x%02x", bp.periph, c.Periph)
+	}
+	// every periph config written once in SPI mode keeps the target powered
+	w := f.sent()
+	for _, b := range w[bytes.IndexByte(w, spiRawMode):] {
+		if b&0xF0 == spiPeriphCfg && b&0x0C != 0x0C {
+			t.Fatalf("wrote periph config 0x%02x, with power or pullups off: % x", b, w)
+		}
+	}
+}
+
+func TestOpenWithRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		err     error
+		retries int
+		ok      bool
+	}{
+		{"not found", errors.New("sp_open: No such file or directory"), 2, true},
+		{"busy", errors.New("sp_open: Device or resource busy"), 1, true},
+		{"errno", fmt.Errorf("open: %w", syscall.ENXIO), 1, true},
+		{"permission", errors.New("sp_open: Permission denied"), 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			openPort := func() (serialPort, error) {
+				if attempts++; attempts <= tc.retries || !tc.ok {
+					return nil, tc.err
+				}
+				return newFakePort(), nil
+			}
+			var retried []int
+			onRetry := OnRetry(func(attempt int, err error) {
+				if err != tc.err {
+					t.Errorf("OnRetry got %v, want %v", err, tc.err)
+				}
+				retried = append(retried, attempt)
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			bp, err := openWithRetry(ctx, openPort, "/dev/fake", 115200, []Option{onRetry})
+			if (err == nil) != tc.ok {
+				t.Fatalf("openWithRetry: %v, want success %v", err, tc.ok)
+			}
+			if tc.ok && bp.mode != ModeBitbang {
+				t.Fatalf("mode %v, want bitbang", bp.mode)
+			}
+			if len(retried) != tc.retries {
+				t.Fatalf("retried %v, want %d retries", retried, tc.retries)
+			}
+		})
+	}
+}
+
+func TestLastDeviceErrorStreaming(t *testing.T) {
+	f := newFakePort()
+	bp := fakeBitbang(t, f)
+	bp.streaming.Store(true)
+	defer bp.streaming.Store(false)
+	if _, err := bp.LastDeviceError(false); !errors.Is(err, ErrStreamActive) {
+		t.Fatalf("LastDeviceError: %v, want ErrStreamActive", err)
+	}
+	if w := f.sent(); len(w) != 0 {
+		t.Fatalf("wrote % x during a stream", w)
+	}
+}
+
+func TestReverseBits(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		if b := byte(i); ReverseBits(ReverseBits(b)) != b {
+			t.Fatalf("ReverseBits(ReverseBits(0x%02x)) = 0x%02x", b, ReverseBits(ReverseBits(b)))
+		}
+	}
+	for _, tc := range [][2]byte{{0x00, 0x00}, {0x01, 0x80}, {0x0F, 0xF0}, {0x12, 0x48}, {0xA5, 0xA5}, {0xFF, 0xFF}} {
+		if got := ReverseBits(tc[0]); got != tc[1] {
+			t.Errorf("ReverseBits(0x%02x) = 0x%02x, want 0x%02x", tc[0], got, tc[1])
+		}
+	}
+
+	data := []byte{0x01, 0x12, 0xF0}
+	out := ReverseBitsSlice(data)
+	if want := []byte{0x80, 0x48, 0x0F}; !bytes.Equal(out, want) {
+		t.Fatalf("ReverseBitsSlice = % x, want % x", out, want)
+	}
+	// a copy: the input is left alone
+	if want := []byte{0x01, 0x12, 0xF0}; !bytes.Equal(data, want) {
+		t.Fatalf("ReverseBitsSlice changed its input to % x", data)
+	}
+	for _, in := range [][]byte{nil, {}} {
+		if out := ReverseBitsSlice(in); out == nil || len(out) != 0 {
+			t.Errorf("ReverseBitsSlice(%#v) = %#v, want an empty slice", in, out)
+		}
+	}
+}
+
+func TestCommandTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		mode Mode
+		run  func(bp *BusPirate) error
+	}{
+		{"spi speed", ModeSpi, func(bp *BusPirate) error { return bp.SpiSpeed(SpiSpeed1mhz) }},
+		{"spi cfg", ModeSpi, func(bp *BusPirate) error { return bp.SpiCfg(true, false, true, false) }},
+		{"spi periph", ModeSpi, func(bp *BusPirate) error { return bp.SpiCfgPeriph(true, false, false, false) }},
+		{"spi cs", ModeSpi, func(bp *BusPirate) error { return bp.SpiCS(true) }},
+		{"spi write/read", ModeSpi, func(bp *BusPirate) error { return bp.SpiWriteRead([]byte{0x9F}, make([]byte, 2)) }},
+		{"ping", ModeSpi, func(bp *BusPirate) error { return bp.Ping() }},
+		{"spi entry", ModeBitbang, func(bp *BusPirate) error { return bp.SpiEnter() }},
+		{"i2c entry", ModeBitbang, func(bp *BusPirate) error { return bp.I2cEnter() }},
+		{"pwm", ModeBitbang, func(bp *BusPirate) error { return bp.SetPWM(0.5) }},
+		{"voltage", ModeBitbang, func(bp *BusPirate) error { _, err := bp.ReadVoltage(); return err }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			opts := []Option{
+				WithModeTimeout(ModeBitbang, 50*time.Millisecond),
+				WithModeTimeout(ModeSpi, 50*time.Millisecond),
+			}
+			var bp *BusPirate
+			if tc.mode == ModeSpi {
+				bp = fakeSpi(t, f, opts...)
+			} else {
+				bp = fakeBitbang(t, f, opts...)
+			}
+			f.mute = true
+			if err := tc.run(bp); !errors.Is(err, ErrTimeout) {
+				t.Fatalf("error %v, want ErrTimeout", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package buspirate
+
+// Config is a snapshot of the device state applied through a BusPirate:
+// the mode and the settings last applied in it. The settings are kept as
+// the command bytes that applied them, 0 for a setting never applied in
+// the mode, so RestoreConfig can re-issue them as they were sent.
+type Config struct {
+	Mode Mode
+
+	// bitbang mode pin direction and pin set (power, pullups and outputs)
+	PinDir byte
+	PinSet byte
+
+	// PWM on AUX; PWMPeriod is 0 with PWM off
+	PWMPrescale byte
+	PWMDuty     uint16
+	PWMPeriod   uint16
+
+	// Periph is the protocol mode peripheral config: power, pullups, AUX
+	// and CS.
+	Periph byte
+
+	SpiSpeed        byte
+	SpiCfg          byte
+	SpiCS           byte
+	SpiCSActiveHigh bool
+	SpiCSPin        Pin // set with SpiSetCSPin, 0 for CS
+
+	I2cSpeed  byte
+	UartSpeed byte
+	UartCfg   byte
+}
+
+// SaveConfig returns a snapshot of the current mode and applied settings.
+// Only what was applied through this BusPirate is known; settings changed
+// directly on the embedded Term aren't seen.
+func (bp *BusPirate) SaveConfig() Config {
+	return Config{
+		Mode:            bp.mode,
+		PinDir:          bp.pinDir,
+		PinSet:          bp.pinSet,
+		PWMPrescale:     bp.pwmPrescale,
+		PWMDuty:         bp.pwmOCR,
+		PWMPeriod:       bp.pwmPRy,
+		Periph:          bp.periph,
+		SpiSpeed:        bp.spiSpeed,
+		SpiCfg:          bp.spiCfg,
+		SpiCS:           bp.spiCS,
+		SpiCSActiveHigh: bp.spiCSActiveHigh,
+		SpiCSPin:        bp.spiCSPin,
+		I2cSpeed:        bp.i2cSpeed,
+		UartSpeed:       bp.uartSpeed,
+		UartCfg:         bp.uartCfg,
+	}
+}
+
+// RestoreConfig re-applies a snapshot taken by SaveConfig, e.g. after the
+// device has been reconnected. The device is reset to bitbang mode, where
+// the pins and PWM are set, and the snapshot's mode is then entered and
+// its settings re-issued in the order the mode needs: for SPI, speed and
+// bus configuration before the peripherals and chip select. A snapshot
+// taken in text mode leaves the device in text mode.
+func (bp *BusPirate) RestoreConfig(c Config) error {
+	if err := bp.BitbangEnter(); err != nil {
+		return err
+	}
+	for _, cmd := range []byte{c.PinDir, c.PinSet} {
+		if cmd == 0 {
+			continue
+		}
+		if _, err := bp.pinCmd(cmd); err != nil {
+			return err
+		}
+	}
+	if c.PWMPeriod != 0 {
+		if err := bp.setPWM(c.PWMPrescale, c.PWMDuty, c.PWMPeriod); err != nil {
+			return err
+		}
+	}
+
+	bp.spiCSActiveHigh = c.SpiCSActiveHigh
+	switch c.Mode {
+	case ModeText:
+		return bp.BitbangLeave()
+	case ModeSpi:
+		if err := bp.SpiEnter(); err != nil {
+			return err
+		}
+		bp.periph, bp.spiSpeed, bp.spiCfg, bp.spiCS = c.Periph, c.SpiSpeed, c.SpiCfg, c.SpiCS
+		if err := bp.spiRestore(); err != nil {
+			return err
+		}
+		// an AUX chip select is back at its level with the periph config,
+		// so only the pin is set; SpiSetCSPin would write the config again
+		bp.spiCSPin = c.SpiCSPin
+		return nil
+	case ModeI2c:
+		if err := bp.I2cEnter(); err != nil {
+			return err
+		}
+		bp.periph, bp.i2cSpeed = c.Periph, c.I2cSpeed
+		return bp.i2cRestore()
+	case ModeUart:
+		if err := bp.UartEnter(); err != nil {
+			return err
+		}
+		bp.periph, bp.uartSpeed, bp.uartCfg = c.Periph, c.UartSpeed, c.UartCfg
+		return bp.uartRestore()
+	case ModeRawWire:
+		return bp.RawEnter()
+	}
+	return nil
+}
@@ -1,13 +1,14 @@
-package buspirate
+package buspirate_test
 
 import (
+    "fmt"
     "time"
 
     "github.com/jpoirier/buspirate"
 )
 // Pulse a LED connected to the AUX pin.
 func ExampleBusPirate_SetPWM() {
-	bp, err := buspirate.Open("/dev/ttyACM0", 5*time.Second)
+	bp, err := buspirate.Open("/dev/ttyACM0", 115200)
 	if err != nil {
 		panic(err)
 	}
@@ -29,3 +30,9 @@ func ExampleBusPirate_SetPWM() {
 		}
 	}
 }
+
+// Prepare data for, and decode data from, an LSB-first SPI device.
+func ExampleReverseBitsSlice() {
+	fmt.Printf("% x\n", buspirate.ReverseBitsSlice([]byte{0x01, 0x80, 0xf0}))
+	// Output: 80 01 0f
+}
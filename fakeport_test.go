@@ -0,0 +1,407 @@
+package buspirate
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jpoirier/lsport"
+)
+
+// fakeBanner is the info command reply of the fake board.
+const fakeBanner = "Bus Pirate v3.b\r\nFirmware v5.10 (r559)  Bootloader v6.1\r\nDEVID:0x0447 REVID:0x3046 (24FJ64GA002 B8)\r\nhttp://dangerousprototypes.com\r\nHiZ>"
+
+// fakePort is a scripted Bus Pirate on the far end of a serial port. It
+// starts in text mode at the top-level prompt and answers the info
+// command, binary mode entry, and the bitbang, SPI and I2C mode commands.
+type fakePort struct {
+	mu      sync.Mutex
+	ready   chan struct{} // signalled when the device sends
+	out     []byte        // sent by the device, not yet read
+	written []byte        // everything written to the device
+
+	// chunk, if set, makes a read return as soon as anything has arrived,
+	// at most chunk bytes, as USB serial adapters deliver replies in
+	// pieces; otherwise a read waits to fill its buffer, as lsport's
+	// blocking reads do.
+	chunk int
+
+	delay    time.Duration // before each reply is sent
+	drainErr error         // returned by Drain
+	hungUp   bool          // reads return at once with nothing
+	early    time.Duration // reads give up after early, as if timed out
+	mute     bool          // replies are dropped, as by a hung device
+	closed   bool
+
+	// once replaces the reply to a single byte command, the next time it's
+	// received, e.g. with a corrupted or doubled reply.
+	once map[byte][]byte
+
+	// target answers each byte clocked out in SPI mode with the byte it
+	// shifts back; nil is a MOSI to MISO loopback.
+	target func(mosi byte) byte
+
+	// i2cNak NAKs the I2C bytes written that it returns true for, address
+	// bytes included; nil ACKs every byte.
+	i2cNak  func(b byte) bool
+	i2cRead []byte // the I2C slave's replies to byte reads, then 0xFF
+	i2cBus  []byte // address and data bytes written on the I2C bus
+
+	pinLow byte // input pins held low, e.g. SCL by a slave; others read high
+
+	mode    Mode
+	menus   int    // text-mode sub-menus the device is in
+	zeros   int    // consecutive 0x00s received in text mode
+	line    []byte // text-mode input line
+	pending []byte // an SPI or I2C command still being received
+	pinDir  byte
+	pinSet  byte
+	csLog   []bool // chip select levels set, in order
+}
+
+func newFakePort() *fakePort {
+	return &fakePort{ready: make(chan struct{}, 1), mode: ModeText}
+}
+
+func (f *fakePort) Write(b []byte) (int, error) {
+	return f.BlockingWrite(b, 0)
+}
+
+func (f *fakePort) BlockingWrite(b []byte, timeout int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, syscall.EBADF
+	}
+	f.written = append(f.written, b...)
+	var r []byte
+	for _, c := range b {
+		r = append(r, f.handle(c)...)
+	}
+	if len(r) > 0 {
+		f.send(r)
+	}
+	return len(b), nil
+}
+
+// send queues the replies to a write, after delay if set.
+func (f *fakePort) send(r []byte) {
+	if f.mute {
+		return
+	}
+	if f.delay == 0 {
+		f.out = append(f.out, r...)
+		f.signal()
+		return
+	}
+	time.AfterFunc(f.delay, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.out = append(f.out, r...)
+		f.signal()
+	})
+}
+
+func (f *fakePort) signal() {
+	select {
+	case f.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (f *fakePort) BlockingRead(b []byte, timeout int) (int, error) {
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	f.mu.Lock()
+	if early := time.Now().Add(f.early); f.early > 0 && early.Before(deadline) {
+		deadline = early
+	}
+	f.mu.Unlock()
+	got := 0
+	for {
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			return got, syscall.EBADF
+		}
+		if f.hungUp {
+			f.mu.Unlock()
+			return got, nil
+		}
+		avail := f.out
+		if f.chunk > 0 && len(avail) > f.chunk {
+			avail = avail[:f.chunk]
+		}
+		n := copy(b[got:], avail)
+		f.out = f.out[n:]
+		got += n
+		f.mu.Unlock()
+		if got == len(b) || got > 0 && f.chunk > 0 {
+			return got, nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return got, nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-f.ready:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+func (f *fakePort) Drain() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.drainErr
+}
+
+func (f *fakePort) Flush(buffers lsport.Buffer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if buffers != lsport.BufOutput {
+		f.out = nil
+	}
+	return nil
+}
+
+func (f *fakePort) SetBaudrate(baudrate int) error {
+	return nil
+}
+
+func (f *fakePort) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.signal()
+	return nil
+}
+
+// sent returns, and forgets, the bytes written to the device so far.
+func (f *fakePort) sent() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := f.written
+	f.written = nil
+	return w
+}
+
+// handle runs one byte received by the device, returning its reply.
+func (f *fakePort) handle(c byte) []byte {
+	if f.pending != nil && f.mode == ModeI2c {
+		return f.i2cData(c)
+	}
+	if f.pending != nil {
+		return f.spiData(c)
+	}
+	if r, ok := f.once[c]; ok && f.mode != ModeText {
+		delete(f.once, c)
+		f.reply(c)
+		return r
+	}
+	return f.reply(c)
+}
+
+func (f *fakePort) reply(c byte) []byte {
+	switch f.mode {
+	case ModeText:
+		return f.text(c)
+	case ModeBitbang:
+		switch {
+		case c == 0x00:
+			return []byte("BBIO1")
+		case c == 0x01:
+			f.mode = ModeSpi
+			return []byte("SPI1")
+		case c == i2cMode:
+			f.mode = ModeI2c
+			return []byte("I2C1")
+		case c == 0x0F:
+			f.mode = ModeText
+			return []byte{0x01}
+		case c == adcRead:
+			return []byte{0x01, 0x00}
+		case c&0xE0 == bbPinDir:
+			f.pinDir = c & 0x1F
+			return []byte{f.pins()}
+		case c&0x80 != 0:
+			f.pinSet = c & 0x7F
+			return []byte{f.pins()}
+		}
+	case ModeSpi:
+		switch {
+		case c == 0x00:
+			f.mode = ModeBitbang
+			return []byte("BBIO1")
+		case c == 0x01:
+			return []byte("SPI1")
+		case c == 0x02 || c == 0x03:
+			f.csLog = append(f.csLog, c == 0x03)
+			return []byte{0x01}
+		case c == spiWriteReadCmd || c == spiWriteReadCmdNoCS:
+			f.pending = []byte{c}
+			return nil
+		case c&0xF0 == spiBulkTransferMode:
+			f.pending = []byte{c}
+			return []byte{0x01}
+		case c&0xF0 == spiPeriphCfg, c&0xF8 == spiSpeedCfg, c&0xF0 == spiCfg:
+			return []byte{0x01}
+		}
+	case ModeI2c:
+		switch {
+		case c == 0x00:
+			f.mode = ModeBitbang
+			return []byte("BBIO1")
+		case c == 0x01:
+			return []byte("I2C1")
+		case c == i2cStart, c == i2cStop, c == i2cAck, c == i2cNak:
+			return []byte{0x01}
+		case c == i2cReadByte:
+			b := byte(0xFF)
+			if len(f.i2cRead) > 0 {
+				b, f.i2cRead = f.i2cRead[0], f.i2cRead[1:]
+			}
+			return []byte{b}
+		case c&0xF0 == i2cBulkWriteMode:
+			f.pending = []byte{c}
+			return []byte{0x01}
+		case c&0xF0 == i2cPeriphCfg, c&0xFC == i2cSpeedCfg:
+			return []byte{0x01}
+		}
+	}
+	return nil
+}
+
+// pins returns the bitbang pin state: outputs as set, and inputs high, as
+// if pulled up, unless held low.
+func (f *fakePort) pins() byte {
+	return f.pinSet&^f.pinDir | f.pinDir&^f.pinLow
+}
+
+// text runs a text-mode byte. In a sub-menu everything but Enter, which
+// backs out a level, is swallowed.
+func (f *fakePort) text(c byte) []byte {
+	if f.menus > 0 {
+		if c != '\n' {
+			return nil
+		}
+		if f.menus--; f.menus > 0 {
+			return []byte("\r\n(1)>")
+		}
+		return []byte("\r\nHiZ>")
+	}
+	if c == 0x00 {
+		if f.zeros++; f.zeros == 20 {
+			f.zeros = 0
+			f.mode = ModeBitbang
+			return []byte("BBIO1")
+		}
+		return nil
+	}
+	f.zeros = 0
+	if c != '\n' {
+		f.line = append(f.line, c)
+		return nil
+	}
+	line := string(f.line)
+	f.line = nil
+	if line == "i" {
+		return []byte(fakeBanner)
+	}
+	return []byte("\r\nHiZ>")
+}
+
+// spiData runs a byte of a multi-byte SPI command.
+func (f *fakePort) spiData(c byte) []byte {
+	f.pending = append(f.pending, c)
+	cmd := f.pending[0]
+	if cmd&0xF0 == spiBulkTransferMode {
+		if len(f.pending)-1 == int(cmd&0x0F)+1 {
+			f.pending = nil
+		}
+		return []byte{f.shift(c)}
+	}
+	if len(f.pending) < 5 {
+		return nil
+	}
+	outCnt := int(f.pending[1])<<8 | int(f.pending[2])
+	inCnt := int(f.pending[3])<<8 | int(f.pending[4])
+	if len(f.pending) < 5+outCnt {
+		return nil
+	}
+	out := f.pending[5:]
+	f.pending = nil
+	if cmd == spiWriteReadCmd {
+		f.csLog = append(f.csLog, false)
+	}
+	for _, b := range out {
+		f.shift(b)
+	}
+	r := []byte{0x01}
+	for i := 0; i < inCnt; i++ {
+		r = append(r, f.shift(0xFF))
+	}
+	if cmd == spiWriteReadCmd {
+		f.csLog = append(f.csLog, true)
+	}
+	return r
+}
+
+// i2cData runs a byte of an I2C bulk write, answered with 0x00 for ACK or
+// 0x01 for NAK.
+func (f *fakePort) i2cData(c byte) []byte {
+	f.pending = append(f.pending, c)
+	if len(f.pending)-1 == int(f.pending[0]&0x0F)+1 {
+		f.pending = nil
+	}
+	f.i2cBus = append(f.i2cBus, c)
+	if f.i2cNak != nil && f.i2cNak(c) {
+		return []byte{0x01}
+	}
+	return []byte{0x00}
+}
+
+func (f *fakePort) shift(mosi byte) byte {
+	if f.target == nil {
+		return mosi
+	}
+	return f.target(mosi)
+}
+
+// fakeBitbang returns a BusPirate on f, in bitbang mode, without the info
+// command and baud rate handling of Open.
+func fakeBitbang(tb testing.TB, f *fakePort, opts ...Option) *BusPirate {
+	tb.Helper()
+	bp := newBusPirate(f, opts)
+	if err := bp.enterBinaryMode(); err != nil {
+		tb.Fatal(err)
+	}
+	f.sent()
+	return bp
+}
+
+// fakeSpi returns a BusPirate on f in SPI mode, with chip select deasserted
+// and its log cleared.
+func fakeSpi(tb testing.TB, f *fakePort, opts ...Option) *BusPirate {
+	tb.Helper()
+	bp := fakeBitbang(tb, f, opts...)
+	if err := bp.SpiEnter(); err != nil {
+		tb.Fatal(err)
+	}
+	f.sent()
+	f.csLog = nil
+	return bp
+}
+
+// fakeI2c returns a BusPirate on f in I2C mode.
+func fakeI2c(tb testing.TB, f *fakePort, opts ...Option) *BusPirate {
+	tb.Helper()
+	bp := fakeBitbang(tb, f, opts...)
+	if err := bp.I2cEnter(); err != nil {
+		tb.Fatal(err)
+	}
+	f.sent()
+	return bp
+}
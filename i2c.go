@@ -0,0 +1,588 @@
+package buspirate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	i2cMode          = 0x02
+	i2cStart         = 0x02
+	i2cStop          = 0x03
+	i2cReadByte      = 0x04
+	i2cAck           = 0x06
+	i2cNak           = 0x07
+	i2cWriteReadCmd  = 0x08
+	i2cBulkWriteMode = 0x10
+	i2cPeriphCfg     = 0x40
+	i2cSpeedCfg      = 0x60
+)
+
+// I2cNakError reports the byte of an I2C write that was not acknowledged.
+// Index 0 is the address byte, index 1 the first data byte.
+type I2cNakError struct {
+	Index int
+}
+
+func (e *I2cNakError) Error() string {
+	return fmt.Sprintf("error, i2c byte %d not acknowledged", e.Index)
+}
+
+// I2cEnter enters binary I2C mode.
+func (bp *BusPirate) I2cEnter() error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
+	if n, err := bp.write([]byte{i2cMode}, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing enter i2c mode, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if n, err := bp.readFull(reply, bp.cmdTimeout()); err != nil || string(reply) != "I2C1" {
+		err = bp.cmdError("error reading enter i2c mode, n: %d, %w", n, replyErr(n, err))
+		bp.flushInput()
+		return err
+	}
+	bp.mode = ModeI2c
+	return nil
+}
+
+// I2cLeave exits I2C mode, returning to bitbang mode.
+func (bp *BusPirate) I2cLeave() error {
+	return bp.BitbangEnter()
+}
+
+// I2cCfgPeriph configures the i2c peripherals.
+// 0100wxyz – Configure peripherals w=power, x=pullups, y=AUX, z=CS
+func (bp *BusPirate) I2cCfgPeriph(power, pullups, aux, cs bool) error {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return err
+	}
+	buf := []byte{i2cPeriphCfg}
+	if power {
+		buf[0] |= 0x08
+	}
+	if pullups {
+		buf[0] |= 0x04
+	}
+	if aux {
+		buf[0] |= 0x02
+	}
+	if cs {
+		buf[0] |= 0x01
+	}
+	if err := bp.writeCfg(buf[0], "i2c periph cfg"); err != nil {
+		return err
+	}
+	bp.periph = buf[0]
+	if bp.periphVerify {
+		return bp.verifyPeriph(func() error {
+			if err := bp.I2cEnter(); err != nil {
+				return err
+			}
+			return bp.i2cRestore()
+		})
+	}
+	return nil
+}
+
+// I2cSpeed is the I2C bus speed
+type I2cSpeed uint8
+
+// I2cSpeed is the I2C bus speed
+const (
+	I2cSpeed5khz I2cSpeed = iota
+	I2cSpeed50khz
+	I2cSpeed100khz
+	I2cSpeed400khz
+	// I2cSpeed1mhz is fast-mode plus. The binary I2C speed command only
+	// encodes 5kHz-400kHz, so no released firmware accepts it; it's
+	// rejected with ErrUnsupported rather than wrapping to 5kHz.
+	I2cSpeed1mhz
+)
+
+var i2cSpeedHz = [...]int{5000, 50000, 100000, 400000, 1000000}
+
+// Hz returns the I2C clock frequency of the speed setting, or 0 for an
+// invalid setting.
+func (s I2cSpeed) Hz() int {
+	if int(s) >= len(i2cSpeedHz) {
+		return 0
+	}
+	return i2cSpeedHz[s]
+}
+
+// NearestI2cSpeed returns the fastest I2C speed the firmware supports that
+// doesn't exceed hz, rounding down so no device on the bus is clocked
+// faster than it allows, e.g. 350kHz gives I2cSpeed100khz. I2cSpeed1mhz,
+// which the firmware rejects, is never returned; hz below 5kHz, the
+// slowest speed, gives I2cSpeed5khz.
+func NearestI2cSpeed(hz int) I2cSpeed {
+	s := I2cSpeed5khz
+	for i := I2cSpeed5khz; i <= I2cSpeed400khz; i++ {
+		if i.Hz() <= hz {
+			s = i
+		}
+	}
+	return s
+}
+
+// I2cSpeed sets I2C bus speed.
+func (bp *BusPirate) I2cSpeed(speed I2cSpeed) error {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return err
+	}
+	if speed > I2cSpeed400khz {
+		return fmt.Errorf("%w: i2c speed %d, the firmware supports up to 400kHz", ErrUnsupported, speed)
+	}
+	cmd := i2cSpeedCfg | byte(speed&0x03)
+	if err := bp.writeCfg(cmd, "i2c speed"); err != nil {
+		return err
+	}
+	bp.i2cSpeed = cmd
+	return nil
+}
+
+// I2cStart sends an I2C start bit.
+func (bp *BusPirate) I2cStart() error {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return err
+	}
+	return bp.writeCmd(i2cStart, "i2c start")
+}
+
+// I2cStop sends an I2C stop bit.
+func (bp *BusPirate) I2cStop() error {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return err
+	}
+	return bp.writeCmd(i2cStop, "i2c stop")
+}
+
+// i2cBulkWrite writes data to the bus, 16 bytes per bulk write command, and
+// returns the index of the first byte that was not acknowledged, or -1.
+// Each exchange with the device may take up to timeout.
+func (bp *BusPirate) i2cBulkWrite(data []byte, timeout time.Duration) (int, error) {
+	for off := 0; off < len(data); off += 16 {
+		chunk := data[off:]
+		if len(chunk) > 16 {
+			chunk = chunk[:16]
+		}
+		l := len(chunk)
+		buf := []byte{i2cBulkWriteMode | byte(l-1)}
+		if n, err := bp.write(buf, timeout); n == 0 || err != nil {
+			return -1, bp.cmdError("error writing i2c bulk write, n: %d, %w", n, timeoutErr(n, err))
+		}
+		if err := bp.drain(); err != nil {
+			return -1, err
+		}
+		if n, err := bp.read(buf, timeout); n == 0 || err != nil {
+			return -1, bp.cmdError("error reading i2c bulk write reply, n: %d, %w", n, timeoutErr(n, err))
+		}
+		if buf[0] != 0x01 {
+			return -1, bp.cmdError("error, i2c bulk write reply is invalid")
+		}
+		// each byte is answered with 0x00 for ACK or 0x01 for NAK
+		for i := 0; i < l; i++ {
+			if n, err := bp.write(chunk[i:i+1], timeout); n == 0 || err != nil {
+				return -1, bp.cmdError("error writing i2c bulk write data, n: %d, %w", n, timeoutErr(n, err))
+			}
+			if err := bp.drain(); err != nil {
+				return -1, err
+			}
+			if n, err := bp.read(buf, timeout); n == 0 || err != nil {
+				return -1, bp.cmdError("error reading i2c bulk write data reply, n: %d, %w", n, timeoutErr(n, err))
+			}
+			if buf[0] != 0x00 {
+				return off + i, nil
+			}
+		}
+	}
+	return -1, nil
+}
+
+// I2cWriteTo writes data to the 7 bit address addr: start, address (write),
+// data, stop. A byte that is not acknowledged is reported as an
+// *I2cNakError, after the stop has been sent.
+func (bp *BusPirate) I2cWriteTo(addr byte, data []byte) error {
+	if err := bp.I2cStart(); err != nil {
+		return err
+	}
+	nak, err := bp.i2cBulkWrite(append([]byte{addr << 1}, data...), bp.cmdTimeout())
+	if err != nil {
+		return err
+	}
+	if err := bp.I2cStop(); err != nil {
+		return err
+	}
+	if nak >= 0 {
+		return &I2cNakError{Index: nak}
+	}
+	return nil
+}
+
+// I2cWriteRead writes 0-4096 bytes to, then reads 0-4096 bytes from, the 7
+// bit address addr in a single transaction, using the device's write then
+// read command: start, address (write), data, repeated start, address
+// (read), readLen bytes with the last one NAKed, stop.
+func (bp *BusPirate) I2cWriteRead(addr byte, data []byte, readLen int) ([]byte, error) {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return nil, err
+	}
+	out := append([]byte{addr << 1}, data...)
+	outCnt := len(out)
+	if outCnt > 4096 {
+		return nil, fmt.Errorf("error, i2c write/read out-data count (0-4096 bytes)")
+	}
+	if readLen < 0 || readLen > 4096 {
+		return nil, fmt.Errorf("error, i2c write/read in-data count (0-4096 bytes)")
+	}
+
+	buf := []byte{i2cWriteReadCmd, byte(outCnt >> 8), byte(outCnt), byte(readLen >> 8), byte(readLen)}
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return nil, bp.cmdError("error writing i2c write/read command, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return nil, err
+	}
+	if n, err := bp.write(out, writeTimeout); n == 0 || err != nil {
+		return nil, bp.cmdError("error writing i2c write/read out-data, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return nil, err
+	}
+	// 0x01 on success, 0x00 if a written byte was not acknowledged
+	if n, err := bp.read(buf[:1], bp.cmdTimeout()); n == 0 || err != nil {
+		return nil, bp.cmdError("error reading i2c write/read status, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if buf[0] != 0x01 {
+		return nil, bp.cmdError("error, i2c write/read not acknowledged")
+	}
+	in := make([]byte, readLen)
+	if readLen > 0 {
+		if n, err := bp.readFull(in, bp.cmdTimeout()); err != nil {
+			return nil, bp.cmdError("error reading i2c write/read in-data, n: %d, %w", n, err)
+		}
+	}
+	return in, nil
+}
+
+// ErrI2cClockStretch is returned when an I2C transfer times out with SCL
+// held low: the slave is stretching the clock for longer than the timeout
+// allows, or is stuck.
+var ErrI2cClockStretch = errors.New("error, i2c clock held low by the slave")
+
+// I2cTransfer writes write to, then reads readLen bytes from, the 7 bit
+// address addr in one transaction: start, address (write), data, repeated
+// start, address (read), readLen bytes with the last one NAKed, stop. With
+// write empty the write phase is skipped, and with readLen 0 the read
+// phase, so it covers plain writes and reads too.
+//
+// It's built from the single step commands rather than the write then
+// read command, so that every byte gets its own timeout: a slave that
+// stretches the clock, e.g. while converting, only has to answer each
+// byte within timeout rather than the whole transfer within a fixed time.
+// The failures are told apart:
+//   - a byte that is not acknowledged is an *I2cNakError, with the read
+//     address counted after the write phase's address and data; a stop is
+//     sent first
+//   - a byte that takes longer than timeout fails with ErrTimeout, or with
+//     ErrI2cClockStretch if SCL is then found held low, which is checked
+//     with I2cBusState; a stop is sent first, to release the bus
+//   - a reply other than 0x01 to a start, ACK, NAK or stop fails, as the
+//     replies are then out of step with the commands
+func (bp *BusPirate) I2cTransfer(addr byte, write []byte, readLen int, timeout time.Duration) ([]byte, error) {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return nil, err
+	}
+	if readLen < 0 {
+		return nil, fmt.Errorf("error, invalid i2c transfer read length: %d", readLen)
+	}
+	in, err := bp.i2cTransfer(addr, write, readLen, timeout)
+	if errors.Is(err, ErrTimeout) {
+		bp.flushInput()
+		bp.I2cStop()
+		if _, scl, serr := bp.I2cBusState(); serr == nil && !scl {
+			return nil, fmt.Errorf("%w: %v", ErrI2cClockStretch, err)
+		}
+	}
+	return in, err
+}
+
+func (bp *BusPirate) i2cTransfer(addr byte, write []byte, readLen int, timeout time.Duration) ([]byte, error) {
+	if len(write) > 0 || readLen == 0 {
+		if err := bp.i2cStep(i2cStart, "i2c start", timeout); err != nil {
+			return nil, err
+		}
+		nak, err := bp.i2cBulkWrite(append([]byte{addr << 1}, write...), timeout)
+		if err != nil {
+			return nil, err
+		}
+		if nak >= 0 {
+			bp.I2cStop()
+			return nil, &I2cNakError{Index: nak}
+		}
+	}
+	in := make([]byte, readLen)
+	if readLen > 0 {
+		if err := bp.i2cStep(i2cStart, "i2c start", timeout); err != nil {
+			return nil, err
+		}
+		nak, err := bp.i2cBulkWrite([]byte{addr<<1 | 0x01}, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if nak >= 0 {
+			bp.I2cStop()
+			// the read address follows the write phase's bytes, if any
+			idx := 0
+			if len(write) > 0 {
+				idx = len(write) + 1
+			}
+			return nil, &I2cNakError{Index: idx}
+		}
+		for i := range in {
+			if in[i], err = bp.i2cCmd(i2cReadByte, "i2c read byte", timeout); err != nil {
+				return nil, err
+			}
+			ack := byte(i2cAck)
+			if i == len(in)-1 {
+				ack = i2cNak
+			}
+			if err := bp.i2cStep(ack, "i2c ack", timeout); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := bp.i2cStep(i2cStop, "i2c stop", timeout); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// i2cCmd sends a single byte I2C command and returns the reply byte,
+// waiting up to timeout for each.
+func (bp *BusPirate) i2cCmd(cmd byte, what string, timeout time.Duration) (byte, error) {
+	buf := []byte{cmd}
+	if n, err := bp.write(buf, timeout); n == 0 || err != nil {
+		return 0, bp.cmdError("error writing %s, n: %d, %w", what, n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return 0, err
+	}
+	if n, err := bp.read(buf, timeout); n == 0 || err != nil {
+		return 0, bp.cmdError("error reading %s reply, n: %d, %w", what, n, timeoutErr(n, err))
+	}
+	return buf[0], nil
+}
+
+// i2cStep is i2cCmd for the commands answered with 0x01: start, stop, ACK
+// and NAK.
+func (bp *BusPirate) i2cStep(cmd byte, what string, timeout time.Duration) error {
+	r, err := bp.i2cCmd(cmd, what, timeout)
+	if err != nil {
+		return err
+	}
+	if r != 0x01 {
+		return bp.cmdError("error, %s reply is invalid", what)
+	}
+	return nil
+}
+
+// I2cBusState reports the level of the SDA (MOSI) and SCL (CLK) lines; an
+// idle bus has both high. The I2C binary protocol can't read the pins, so
+// the device is dropped to bitbang mode, with the pins as inputs and the
+// power and pullups as last configured, and I2C mode is then re-entered
+// with the last applied peripheral config and speed.
+func (bp *BusPirate) I2cBusState() (sda, scl bool, err error) {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return false, false, err
+	}
+	if err := bp.bitbangReset(); err != nil {
+		return false, false, err
+	}
+	if _, err := bp.pinCmd(bbPinDir | pinAUX | pinMOSI | pinCLK | pinMISO | pinCS); err != nil {
+		return false, false, err
+	}
+	set := byte(bbPinSet)
+	if bp.periph&0x08 != 0 {
+		set |= pinPower
+	}
+	if bp.periph&0x04 != 0 {
+		set |= pinPullup
+	}
+	state, err := bp.pinCmd(set)
+	if err != nil {
+		return false, false, err
+	}
+	if err := bp.I2cEnter(); err != nil {
+		return false, false, err
+	}
+	if err := bp.i2cRestore(); err != nil {
+		return false, false, err
+	}
+	return state&pinMOSI != 0, state&pinCLK != 0, nil
+}
+
+// i2cRestore re-issues the stored I2C settings after I2C mode is re-entered.
+func (bp *BusPirate) i2cRestore() error {
+	for _, cmd := range []byte{bp.periph, bp.i2cSpeed} {
+		if cmd == 0 {
+			continue
+		}
+		if err := bp.writeCfg(cmd, fmt.Sprintf("i2c restore 0x%02x", cmd)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// I2cRecoverBus frees a bus whose SDA line is held low by a slave left mid
+// byte: a byte read clocks 8 pulses with SDA released, the NAK the 9th, and
+// a stop returns the bus to idle.
+func (bp *BusPirate) I2cRecoverBus() error {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return err
+	}
+	if _, err := bp.i2cRead(); err != nil {
+		return err
+	}
+	if err := bp.writeCmd(i2cNak, "i2c nak"); err != nil {
+		return err
+	}
+	return bp.I2cStop()
+}
+
+// I2cReadByte clocks in a byte from the bus with the read byte command,
+// 0x04, whose reply is the byte read, and then acknowledges it with the
+// ACK command, 0x06, if ack is set, or the NAK command, 0x07, if not; the
+// device answers the ACK or NAK with 0x01, which is checked. It's the step
+// the read helpers repeat, for composing a read by hand after the address
+// has been written: ACK every byte but the last, and NAK the last so the
+// slave releases SDA for the stop.
+func (bp *BusPirate) I2cReadByte(ack bool) (byte, error) {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return 0, err
+	}
+	b, err := bp.i2cRead()
+	if err != nil {
+		return 0, err
+	}
+	if ack {
+		err = bp.writeCmd(i2cAck, "i2c ack")
+	} else {
+		err = bp.writeCmd(i2cNak, "i2c nak")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return b, nil
+}
+
+// i2cRead clocks in a byte from the bus, leaving the ACK/NAK to the caller.
+func (bp *BusPirate) i2cRead() (byte, error) {
+	buf := []byte{i2cReadByte}
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return 0, bp.cmdError("error writing i2c read byte, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return 0, err
+	}
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil {
+		return 0, bp.cmdError("error reading i2c read byte reply, n: %d, %w", n, timeoutErr(n, err))
+	}
+	return buf[0], nil
+}
+
+// I2cReadStream addresses the 7 bit address addr for reading and streams
+// the bytes it returns, ACKing each, until ctx is done. The byte read after
+// ctx is done is NAKed and dropped, and a stop is sent, so the slave
+// releases the bus. The channel is closed once the bus is released or on an
+// I/O error; until then other commands fail with ErrStreamActive.
+//
+// Every byte costs two USB round trips, a read and an ACK, which limits the
+// stream to a few hundred bytes per second on typical adapters.
+func (bp *BusPirate) I2cReadStream(ctx context.Context, addr byte) (<-chan byte, error) {
+	if err := bp.I2cStart(); err != nil {
+		return nil, err
+	}
+	nak, err := bp.i2cBulkWrite([]byte{addr<<1 | 0x01}, bp.cmdTimeout())
+	if err != nil {
+		return nil, err
+	}
+	if nak >= 0 {
+		bp.I2cStop()
+		return nil, &I2cNakError{Index: nak}
+	}
+
+	// other commands fail with ErrStreamActive until the stream ends
+	bp.streaming.Store(true)
+	ch := make(chan byte)
+	go func() {
+		defer func() {
+			bp.streaming.Store(false)
+			close(ch)
+		}()
+		for {
+			b, err := bp.i2cRead()
+			if err != nil {
+				return
+			}
+			if ctx.Err() != nil {
+				if err := bp.writeCmd(i2cNak, "i2c nak"); err != nil {
+					return
+				}
+				bp.writeCmd(i2cStop, "i2c stop")
+				return
+			}
+			if err := bp.writeCmd(i2cAck, "i2c ack"); err != nil {
+				return
+			}
+			select {
+			case ch <- b:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// I2cBus adapts a BusPirate in I2C mode to the Tx convention of
+// periph.io's i2c.Bus, so drivers written against that interface can run
+// on the Bus Pirate. Speed is set with BusPirate.I2cSpeed rather than
+// periph's SetSpeed, which takes a periph physic.Frequency, and only 7 bit
+// addresses are supported.
+type I2cBus struct {
+	bp *BusPirate
+}
+
+// NewI2cBus returns an I2cBus using bp, which must already be in I2C mode.
+func NewI2cBus(bp *BusPirate) *I2cBus {
+	return &I2cBus{bp: bp}
+}
+
+// Tx writes w to, then reads len(r) bytes into r from, the device at addr
+// in one transaction, with a repeated start between the write and the read.
+// Either w or r may be empty.
+func (b *I2cBus) Tx(addr uint16, w, r []byte) error {
+	if addr > 0x7F {
+		return fmt.Errorf("%w: 10 bit i2c address 0x%x", ErrUnsupported, addr)
+	}
+	if len(r) == 0 {
+		return b.bp.I2cWriteTo(byte(addr), w)
+	}
+	in, err := b.bp.I2cWriteRead(byte(addr), w, len(r))
+	if err != nil {
+		return err
+	}
+	copy(r, in)
+	return nil
+}
+
+func (b *I2cBus) String() string {
+	return "buspirate i2c"
+}
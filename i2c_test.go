@@ -0,0 +1,119 @@
+package buspirate
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+const fakeI2cAddr = 0x50
+
+func TestI2cTransfer(t *testing.T) {
+	f := newFakePort()
+	bp := fakeI2c(t, f)
+	f.i2cRead = []byte{0x11, 0x22, 0x33}
+	in, err := bp.I2cTransfer(fakeI2cAddr, []byte{0x10}, 3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x11, 0x22, 0x33}; !bytes.Equal(in, want) {
+		t.Fatalf("read % x, want % x", in, want)
+	}
+	want := []byte{
+		i2cStart, i2cBulkWriteMode | 1, 0xA0, 0x10,
+		i2cStart, i2cBulkWriteMode, 0xA1,
+		i2cReadByte, i2cAck, i2cReadByte, i2cAck, i2cReadByte, i2cNak,
+		i2cStop,
+	}
+	if got := f.sent(); !bytes.Equal(got, want) {
+		t.Fatalf("wrote % x, want % x", got, want)
+	}
+}
+
+func TestI2cTransferNak(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		write   []byte
+		readLen int
+		nak     byte
+		index   int
+	}{
+		{"write address", nil, 0, 0xA0, 0},
+		{"write data", []byte{0x10, 0x20}, 0, 0x20, 2},
+		{"read address", []byte{0x10, 0x20}, 2, 0xA1, 3},
+		{"read address without write", nil, 2, 0xA1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			bp := fakeI2c(t, f)
+			f.i2cNak = func(b byte) bool { return b == tc.nak }
+			_, err := bp.I2cTransfer(fakeI2cAddr, tc.write, tc.readLen, time.Second)
+			var nak *I2cNakError
+			if !errors.As(err, &nak) {
+				t.Fatalf("I2cTransfer: %v, want an *I2cNakError", err)
+			}
+			if nak.Index != tc.index {
+				t.Fatalf("NAK index %d, want %d", nak.Index, tc.index)
+			}
+			if w := f.sent(); w[len(w)-1] != i2cStop {
+				t.Fatalf("wrote % x, want a stop last", w)
+			}
+		})
+	}
+}
+
+func TestI2cTransferReplies(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cmd  byte
+	}{
+		{"start", i2cStart},
+		{"ack", i2cAck},
+		{"nak", i2cNak},
+		{"stop", i2cStop},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			bp := fakeI2c(t, f)
+			// a reply byte out of step, e.g. a read byte left unread
+			f.once = map[byte][]byte{tc.cmd: {0x42}}
+			if in, err := bp.I2cTransfer(fakeI2cAddr, []byte{0x10}, 2, time.Second); err == nil {
+				t.Fatalf("I2cTransfer read % x past a bad %s reply", in, tc.name)
+			}
+		})
+	}
+}
+
+func TestI2cTransferTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pinLow  byte
+		stretch bool
+	}{
+		{"timeout", 0, false},
+		{"clock stretch", pinCLK, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			bp := fakeI2c(t, f)
+			// the slave holds the byte read
+			f.once = map[byte][]byte{i2cReadByte: nil}
+			f.pinLow = tc.pinLow
+			_, err := bp.I2cTransfer(fakeI2cAddr, nil, 1, 50*time.Millisecond)
+			if got := errors.Is(err, ErrI2cClockStretch); got != tc.stretch {
+				t.Fatalf("I2cTransfer: %v, clock stretch %v, want %v", err, got, tc.stretch)
+			}
+			if !tc.stretch && !errors.Is(err, ErrTimeout) {
+				t.Fatalf("I2cTransfer: %v, want ErrTimeout", err)
+			}
+			want := []byte{i2cStart, i2cBulkWriteMode, 0xA1, i2cReadByte, i2cStop}
+			if w := f.sent(); !bytes.HasPrefix(w, want) {
+				t.Fatalf("wrote % x, want % x first", w, want)
+			}
+			if bp.Mode() != ModeI2c {
+				t.Fatalf("mode %v after the bus check, want i2c", bp.Mode())
+			}
+		})
+	}
+}
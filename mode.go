@@ -0,0 +1,122 @@
+package buspirate
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Mode is the device mode a BusPirate is in.
+type Mode int
+
+// Mode is the device mode a BusPirate is in.
+const (
+	ModeText Mode = iota
+	ModeBitbang
+	ModeSpi
+	ModeI2c
+	ModeUart
+	ModeRawWire
+)
+
+var modeNames = []string{
+	ModeText:    "text",
+	ModeBitbang: "bitbang",
+	ModeSpi:     "spi",
+	ModeI2c:     "i2c",
+	ModeUart:    "uart",
+	ModeRawWire: "raw-wire",
+}
+
+func (m Mode) String() string {
+	if m >= 0 && int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// ErrWrongMode is returned when a command is issued in a mode it doesn't
+// belong to, e.g. SpiSend before SpiEnter.
+var ErrWrongMode = errors.New("error, command not valid in the current mode")
+
+// ErrStreamActive is returned for a command issued while a stream, e.g.
+// ReadVoltageStream, owns the device. The stream's replies would otherwise
+// interleave with the command's.
+var ErrStreamActive = errors.New("error, a stream is active")
+
+// binaryModes are the modes reached through the binary protocol.
+var binaryModes = []Mode{ModeBitbang, ModeSpi, ModeI2c, ModeUart, ModeRawWire}
+
+// Mode returns the mode the device is in, as tracked from the successful
+// mode transitions.
+func (bp *BusPirate) Mode() Mode {
+	return bp.mode
+}
+
+// checkMode returns ErrWrongMode unless the device is in one of modes, or
+// ErrStreamActive while a stream is running.
+func (bp *BusPirate) checkMode(modes ...Mode) error {
+	if bp.streaming.Load() {
+		return ErrStreamActive
+	}
+	for _, m := range modes {
+		if bp.mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w (%v)", ErrWrongMode, bp.mode)
+}
+
+// PanicError is returned by RunInMode, when Open was given
+// WithPanicRecovery, for a panic in the function it ran.
+type PanicError struct {
+	Value interface{} // the value passed to panic
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("error, panic in RunInMode: %v", e.Value)
+}
+
+// RunInMode enters mode from bitbang mode, runs fn and returns the device
+// to bitbang mode with ToBitbang, which also flushes any input left
+// unread. The return to bitbang mode happens however fn ends, including
+// by a panic, so a bug in fn can't leave the device mid transaction, e.g.
+// with chip select asserted. After the cleanup a panic is re-raised, or,
+// with WithPanicRecovery, returned as a *PanicError. An error from fn is
+// returned in preference to one from leaving the mode.
+func (bp *BusPirate) RunInMode(mode Mode, fn func() error) (err error) {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
+	var enter func() error
+	switch mode {
+	case ModeBitbang:
+		enter = func() error { return nil }
+	case ModeSpi:
+		enter = bp.SpiEnter
+	case ModeI2c:
+		enter = bp.I2cEnter
+	case ModeUart:
+		enter = bp.UartEnter
+	case ModeRawWire:
+		enter = bp.RawEnter
+	default:
+		return fmt.Errorf("error, RunInMode can't enter %v mode", mode)
+	}
+	defer func() {
+		r := recover()
+		if leaveErr := bp.ToBitbang(); err == nil {
+			err = leaveErr
+		}
+		if r == nil {
+			return
+		}
+		if !bp.panicRecovery {
+			panic(r)
+		}
+		err = &PanicError{Value: r}
+	}()
+	if err := enter(); err != nil {
+		return err
+	}
+	return fn()
+}
@@ -0,0 +1,209 @@
+package buspirate
+
+import (
+	"time"
+)
+
+// Option configures optional BusPirate behavior at Open.
+type Option func(*BusPirate)
+
+// WithPreambleNewlines sets the number of newlines sent ahead of the binary
+// mode handshake to back the device out of any text-mode sub-menu it was
+// left in. The default is 10.
+func WithPreambleNewlines(n int) Option {
+	return func(bp *BusPirate) {
+		if n >= 0 {
+			bp.preamble = n
+		}
+	}
+}
+
+// WithSpiCSActiveHigh marks the SPI chip select as active high: SpiEnter
+// drives it low to deselect the chip and WithCS drives it high to select
+// it. Chip select is active low by default.
+func WithSpiCSActiveHigh() Option {
+	return func(bp *BusPirate) {
+		bp.spiCSActiveHigh = true
+	}
+}
+
+// WithoutSpiCSDeassert leaves chip select in whatever state the device puts
+// it in on SpiEnter, rather than deasserting it.
+func WithoutSpiCSDeassert() Option {
+	return func(bp *BusPirate) {
+		bp.spiCSKeep = true
+	}
+}
+
+// WithSpiStrictCS makes SpiSend fail with ErrSpiCSDeasserted unless chip
+// select was last set to its active level, catching transfers to a
+// deselected chip, which silently read back 0xFF. The check uses the chip
+// select state tracked by SpiCS, so it costs no extra round trip.
+func WithSpiStrictCS() Option {
+	return func(bp *BusPirate) {
+		bp.spiStrictCS = true
+	}
+}
+
+// WithPeriphVerify makes SpiCfgPeriph and I2cCfgPeriph read back the power,
+// pullup, AUX and CS state and fail if it doesn't match the request. The
+// protocol modes can't read the pins, so each verification is a round trip
+// through bitbang mode that briefly resets the outputs. It checks the
+// device applied the settings, not the rail voltages; see ReadVoltage.
+func WithPeriphVerify() Option {
+	return func(bp *BusPirate) {
+		bp.periphVerify = true
+	}
+}
+
+// WithEchoSkip drops an echo of the command bytes from the front of each
+// reply. Official firmware doesn't echo binary commands, but some clone
+// firmwares do, which shows up as "reply is invalid" errors, e.g. reading
+// the echoed 0x01 instead of "SPI1". A reply that legitimately starts with
+// the bytes just sent, e.g. an SPI loopback, is misread with this on, so
+// leave it off unless the board needs it.
+func WithEchoSkip() Option {
+	return func(bp *BusPirate) {
+		bp.echoSkip = true
+	}
+}
+
+// WithoutDrain skips the Drain after each command write, relying on the
+// blocking reply read that follows for synchronization. Drain waits for the
+// OS to hand the bytes to the adapter, a round trip per write, and SpiSend
+// writes once per byte. BenchmarkSpiBulk16's transfer over a Linux 6.18
+// pty, whose drain waits on no hardware, took about 15µs per command
+// with Drain and 13µs without; no USB adapter was measured, so compare
+// Stats().IOTime on the link in use. Without it, a write error may only
+// surface as a missing reply, so keep Drain on unless throughput matters.
+func WithoutDrain() Option {
+	return func(bp *BusPirate) {
+		bp.noDrain = true
+	}
+}
+
+// WithReadDelay waits d after each command write before reading the reply,
+// for clone boards whose firmware is slow to answer and leaves the reply
+// read racing ahead of it. The default is no delay.
+func WithReadDelay(d time.Duration) Option {
+	return func(bp *BusPirate) {
+		bp.readDelay = d
+	}
+}
+
+// WithSpiCSSettle makes SpiWriteRead wait d after asserting chip select
+// before the first clock, and d after the last clock before deasserting
+// it, for devices with a CS setup or hold time longer than the write then
+// read command gives. The command manages chip select itself and has no
+// delay setting, so with this set the library asserts and deasserts chip
+// select with separate commands around the no-CS variant; the actual
+// delay is d plus a USB round trip. The default is no delay.
+func WithSpiCSSettle(d time.Duration) Option {
+	return func(bp *BusPirate) {
+		bp.spiCSSettle = d
+	}
+}
+
+// WithoutBinaryMode leaves the device in text mode at Open, for sessions
+// that start with text-mode work, e.g. reading the info banner. The port
+// is opened and the baud rate set as usual; EnterBinary switches to binary
+// mode later. Every BusPirate command other than EnterBinary needs binary
+// mode, so most users want the default.
+func WithoutBinaryMode() Option {
+	return func(bp *BusPirate) {
+		bp.textMode = true
+	}
+}
+
+// WithPanicRecovery makes RunInMode return a panic in the function it runs
+// as a *PanicError, after the device has been returned to bitbang mode,
+// rather than re-raise it.
+func WithPanicRecovery() Option {
+	return func(bp *BusPirate) {
+		bp.panicRecovery = true
+	}
+}
+
+// WithSpiChunkSize sets the largest write then read command SpiWriteRead
+// issues, clamped to 1-4096 bytes, the command's limit and the default.
+// Transfers larger than the chunk size are split; each chunk costs a few
+// USB round trips, so large chunks are the fastest, while smaller ones let
+// a SpiWriteReadContext cancellation take effect sooner.
+func WithSpiChunkSize(n int) Option {
+	return func(bp *BusPirate) {
+		if n < 1 {
+			n = 1
+		}
+		if n > 4096 {
+			n = 4096
+		}
+		bp.spiChunk = n
+	}
+}
+
+// WithBaudDetect makes Open look for a device that doesn't answer at
+// 115200 at the other baud rates Open can set, 500000, 1000000 and
+// 2000000, as a v3 board keeps a rate set by an earlier Open until it's
+// power cycled. The rate found is reported by DetectedBaudrate, and the
+// board is then set to the baud rate passed to Open as usual.
+func WithBaudDetect() Option {
+	return func(bp *BusPirate) {
+		bp.baudDetect = true
+	}
+}
+
+// WithModeTimeout sets how long commands wait for the device's reply in
+// mode, in place of the 2s default every mode starts with, e.g. longer for
+// an I2C target that stretches the clock for a slow conversion, or
+// shorter in SPI mode to notice a hung link sooner. It applies to the
+// commands of the mode and to leaving it; entering a mode is a bitbang
+// mode command. Calls that take their own timeout, like I2cTransfer and
+// PowerOnTimeout, use that instead. d must be positive.
+func WithModeTimeout(mode Mode, d time.Duration) Option {
+	return func(bp *BusPirate) {
+		if d <= 0 {
+			return
+		}
+		if bp.modeTimeouts == nil {
+			bp.modeTimeouts = make(map[Mode]time.Duration)
+		}
+		bp.modeTimeouts[mode] = d
+	}
+}
+
+// WithStrictAcks makes the single byte configuration commands, e.g.
+// SpiSpeed or I2cCfgPeriph, fail with ErrUnexpectedReply when anything
+// follows their 0x01 reply. Each command reads exactly its own reply, so
+// extra bytes mean the session is out of step with the device, e.g. a
+// reply to an earlier command arriving late or an unexpected UART echo;
+// strict mode catches that at the command that saw it, rather than some
+// commands later as a bad reply. The check waits 20ms for stray bytes
+// after every configuration command.
+func WithStrictAcks() Option {
+	return func(bp *BusPirate) {
+		bp.strictAcks = true
+	}
+}
+
+// WithSpiFillByte sets the byte SpiRead and SpiReadRegister clock out
+// while reading; the default is 0xFF, which flash and most devices expect
+// on an idle MOSI. Some devices want 0x00, or treat 0xFF as a command.
+// Fill bytes other than 0xFF are sent with bulk transfers, which cost a
+// USB round trip per byte rather than streaming the read.
+func WithSpiFillByte(b byte) Option {
+	return func(bp *BusPirate) {
+		bp.spiFill = b
+	}
+}
+
+// OnRetry sets a function OpenWithRetry calls with each failed port open
+// it's about to retry, attempt counting from 1, e.g. to log a board that's
+// slow to enumerate or to give up sooner after a number of attempts by
+// cancelling the context. It's called on the goroutine calling
+// OpenWithRetry, before the wait for the next attempt, and not for the
+// failure OpenWithRetry returns. Open ignores it.
+func OnRetry(fn func(attempt int, err error)) Option {
+	return func(bp *BusPirate) {
+		bp.onRetry = fn
+	}
+}
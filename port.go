@@ -0,0 +1,398 @@
+package buspirate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jpoirier/lsport"
+)
+
+// Stats holds the port I/O counters of a BusPirate.
+type Stats struct {
+	BytesWritten uint64
+	BytesRead    uint64
+	Commands     uint64        // port writes issued
+	IOTime       time.Duration // time spent in port writes, reads and drains
+}
+
+// stats are the live counters behind Stats, updated atomically.
+type stats struct {
+	written  atomic.Uint64
+	read     atomic.Uint64
+	commands atomic.Uint64
+	ioTime   atomic.Int64
+}
+
+// Stats returns a snapshot of the port I/O counters since Open. Comparing
+// BytesWritten+BytesRead against IOTime gives the effective throughput; a
+// high Commands count relative to the bytes moved points at USB round-trip
+// latency as the bottleneck.
+func (bp *BusPirate) Stats() Stats {
+	return Stats{
+		BytesWritten: bp.stats.written.Load(),
+		BytesRead:    bp.stats.read.Load(),
+		Commands:     bp.stats.commands.Load(),
+		IOTime:       time.Duration(bp.stats.ioTime.Load()),
+	}
+}
+
+// wireLogMax caps the bytes kept for a CommandError, so a 4096 byte
+// transfer doesn't end up in an error message.
+const wireLogMax = 16
+
+// wireLog holds the bytes of the command exchange in progress: the writes
+// since the last reply, and the reply read since.
+type wireLog struct {
+	cmd     []byte
+	reply   []byte
+	replied bool
+}
+
+func appendCapped(dst, b []byte) []byte {
+	if room := wireLogMax - len(dst); len(b) > room {
+		b = b[:room]
+	}
+	return append(dst, b...)
+}
+
+// CommandError is the error returned when a command fails on the wire. It
+// carries the bytes sent for the command and the bytes read back, the
+// first 16 of each, so a single error line shows what went over the wire.
+// The underlying error, e.g. ErrTimeout, is available to errors.Is.
+type CommandError struct {
+	Cmd   []byte
+	Reply []byte
+	Err   error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%v (cmd: % x, reply: % x)", e.Err, e.Cmd, e.Reply)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// cmdError formats an error as fmt.Errorf does and wraps it in a
+// CommandError with the current command exchange.
+func (bp *BusPirate) cmdError(format string, a ...interface{}) error {
+	err := fmt.Errorf(format, a...)
+	if !errors.Is(err, ErrDeviceDisconnected) {
+		// most commands format the port error with %v; keep a
+		// disconnection visible to errors.Is all the same
+		for _, arg := range a {
+			if aerr, ok := arg.(error); ok && errors.Is(aerr, ErrDeviceDisconnected) {
+				err = &causeError{msg: err.Error(), cause: ErrDeviceDisconnected}
+				break
+			}
+		}
+	}
+	return &CommandError{
+		Cmd:   append([]byte(nil), bp.wire.cmd...),
+		Reply: append([]byte(nil), bp.wire.reply...),
+		Err:   err,
+	}
+}
+
+// causeError is an error message that unwraps to a cause it doesn't wrap
+// textually.
+type causeError struct {
+	msg   string
+	cause error
+}
+
+func (e *causeError) Error() string { return e.msg }
+func (e *causeError) Unwrap() error { return e.cause }
+
+// Timeouts are time.Durations throughout; the port's blocking reads and
+// writes take milliseconds, and termRead and termWrite, which every port
+// read and write goes through, are the only place that converts.
+
+// writeTimeout bounds a command write; the port takes a write at once
+// unless its output buffer is full.
+const writeTimeout = 2 * time.Second
+
+// millis converts a timeout to the milliseconds taken by the blocking
+// port reads and writes. It's never below 1, as 0 blocks forever.
+func millis(d time.Duration) int {
+	if d < time.Millisecond {
+		return 1
+	}
+	return int(d / time.Millisecond)
+}
+
+// serialPort is the port a BusPirate talks to the device through: an
+// *lsport.Term in use, and a scripted fake in the tests.
+type serialPort interface {
+	Write(b []byte) (int, error)
+	BlockingRead(b []byte, timeout int) (int, error)
+	BlockingWrite(b []byte, timeout int) (int, error)
+	Drain() error
+	Flush(buffers lsport.Buffer) error
+	SetBaudrate(baudrate int) error
+	Close() error
+}
+
+// termRead is term.BlockingRead with a Duration timeout.
+func termRead(term serialPort, b []byte, timeout time.Duration) (int, error) {
+	start := time.Now()
+	n, err := term.BlockingRead(b, millis(timeout))
+	return n, portError(n, len(b), err, start, timeout)
+}
+
+// termWrite is term.BlockingWrite with a Duration timeout.
+func termWrite(term serialPort, b []byte, timeout time.Duration) (int, error) {
+	start := time.Now()
+	n, err := term.BlockingWrite(b, millis(timeout))
+	return n, portError(n, len(b), err, start, timeout)
+}
+
+// ErrDeviceDisconnected is returned when the port fails because the device
+// has gone away, unplugged or reset off the bus, or the port was closed.
+// Retrying is pointless: the port has to be closed and the device opened
+// again once it's back.
+var ErrDeviceDisconnected = errors.New("error, device disconnected")
+
+// hangupElapsed and hangupTimeout bound the empty reads and writes
+// portError takes for a hung up port.
+const (
+	hangupElapsed = time.Millisecond
+	hangupTimeout = 100 * time.Millisecond
+)
+
+// portError wraps err in ErrDeviceDisconnected if it's a disconnection. A
+// port that hung up, e.g. a ttyACM whose device reset, returns from a
+// blocking read or write at once, with nothing moved and no error. That
+// assumes the port never returns so early otherwise, which only holds for
+// long waits: an empty read or write is taken for a hangup if it returns
+// within hangupElapsed of a timeout of at least hangupTimeout. An early
+// return from a shorter timeout, e.g. one the port rounds to deciseconds,
+// is a plain timeout; a disconnection then shows only in the error.
+func portError(n, want int, err error, start time.Time, timeout time.Duration) error {
+	if err == nil {
+		elapsed := time.Since(start)
+		if n > 0 || want == 0 || timeout < hangupTimeout || elapsed >= hangupElapsed {
+			return nil
+		}
+		return fmt.Errorf("%w: port returned without data after %v of %v", ErrDeviceDisconnected, elapsed.Round(time.Microsecond), timeout)
+	}
+	if disconnected(err) {
+		return fmt.Errorf("%w: %v", ErrDeviceDisconnected, err)
+	}
+	return err
+}
+
+// disconnected reports whether a port error means the device is gone: on
+// Linux an unplugged ttyACM or ttyUSB fails with EIO, or ENODEV if reopened,
+// on macOS with ENXIO, "device not configured", on Windows with "the device
+// is not connected" or "does not recognize the command", and a closed port
+// with EBADF.
+func disconnected(err error) bool {
+	if errors.Is(err, ErrDeviceDisconnected) {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.ENXIO, syscall.ENODEV, syscall.EBADF} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{
+		"input/output error",
+		"no such device",
+		"device not configured",
+		"device is not connected",
+		"does not recognize the command",
+		"bad file descriptor",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// write is the counted BlockingWrite all commands go through.
+func (bp *BusPirate) write(b []byte, timeout time.Duration) (int, error) {
+	start := time.Now()
+	n, err := termWrite(bp.port, b, timeout)
+	bp.stats.ioTime.Add(int64(time.Since(start)))
+	bp.stats.commands.Add(1)
+	bp.stats.written.Add(uint64(n))
+	if bp.echoSkip {
+		bp.echo = append(bp.echo[:0], b[:n]...)
+	}
+	if bp.wire.replied {
+		bp.wire.cmd = bp.wire.cmd[:0]
+		bp.wire.reply = bp.wire.reply[:0]
+		bp.wire.replied = false
+	}
+	bp.wire.cmd = appendCapped(bp.wire.cmd, b[:n])
+	return n, err
+}
+
+// read is the counted BlockingRead all replies go through.
+func (bp *BusPirate) read(b []byte, timeout time.Duration) (int, error) {
+	n, err := bp.blockingRead(b, timeout)
+	if bp.echoSkip && len(bp.echo) > 0 && err == nil {
+		n, err = bp.skipEcho(b, n, timeout)
+	}
+	bp.wire.reply = appendCapped(bp.wire.reply, b[:n])
+	bp.wire.replied = true
+	return n, err
+}
+
+// readFull reads until b is full or timeout passes. USB serial adapters
+// often deliver a reply in pieces, so a single read of a multi-byte reply
+// can come up short even though the device sent all of it. A short read
+// returns the bytes read so far and ErrTimeout.
+func (bp *BusPirate) readFull(b []byte, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	got := 0
+	for got < len(b) {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return got, ErrTimeout
+		}
+		n, err := bp.read(b[got:], wait)
+		got += n
+		if err != nil {
+			return got, err
+		}
+	}
+	return got, nil
+}
+
+func (bp *BusPirate) blockingRead(b []byte, timeout time.Duration) (int, error) {
+	start := time.Now()
+	n, err := termRead(bp.port, b, timeout)
+	bp.stats.ioTime.Add(int64(time.Since(start)))
+	bp.stats.read.Add(uint64(n))
+	return n, err
+}
+
+// skipEcho drops an echo of the last bytes written from the front of the n
+// bytes read into b, then reads on to fill b. A read that doesn't start
+// with the echo is left alone.
+func (bp *BusPirate) skipEcho(b []byte, n int, timeout time.Duration) (int, error) {
+	skipped := false
+	for n > 0 && len(bp.echo) > 0 {
+		k := n
+		if k > len(bp.echo) {
+			k = len(bp.echo)
+		}
+		if !bytes.Equal(b[:k], bp.echo[:k]) {
+			break
+		}
+		copy(b, b[k:n])
+		n -= k
+		bp.echo = bp.echo[k:]
+		skipped = true
+		if n == 0 {
+			m, err := bp.blockingRead(b, timeout)
+			if err != nil {
+				return m, err
+			}
+			n = m
+		}
+	}
+	bp.echo = bp.echo[:0]
+	if skipped && n > 0 && n < len(b) {
+		m, err := bp.blockingRead(b[n:], timeout)
+		return n + m, err
+	}
+	return n, nil
+}
+
+// drain is the timed Drain all commands go through, between a command
+// write and its reply read. The Drain is skipped when Open was given
+// WithoutDrain, and the WithReadDelay delay, if any, follows it. A port
+// that can't drain gets drainFallback instead, logged the first time.
+func (bp *BusPirate) drain() error {
+	var err error
+	if !bp.noDrain {
+		start := time.Now()
+		var fellBack bool
+		fellBack, err = drainOrSleep(bp.port)
+		bp.stats.ioTime.Add(int64(time.Since(start)))
+		if fellBack && !bp.drainLogged {
+			bp.drainLogged = true
+			log.Printf("buspirate: serial port drain not supported, waiting %v after writes instead", drainFallback)
+		}
+	}
+	if bp.readDelay > 0 {
+		time.Sleep(bp.readDelay)
+	}
+	return err
+}
+
+// drainFallback is the wait after a write on a port that can't drain. The
+// ports that can't, ptys and sockets behind socat and the like, pass
+// writes on at once, so it only needs to cover the scheduling of the far
+// end.
+const drainFallback = 2 * time.Millisecond
+
+// drainOrSleep drains term, or sleeps for drainFallback if the port
+// doesn't support draining, reporting the fallback.
+func drainOrSleep(term serialPort) (fellBack bool, err error) {
+	err = term.Drain()
+	if err != nil && disconnected(err) {
+		return false, fmt.Errorf("%w: %v", ErrDeviceDisconnected, err)
+	}
+	if err == nil || !drainUnsupported(err) {
+		return false, err
+	}
+	time.Sleep(drainFallback)
+	return true, nil
+}
+
+// termDrain is drainOrSleep for the handshake and text-mode helpers that
+// talk to the port before there's a BusPirate.
+func termDrain(term serialPort) error {
+	_, err := drainOrSleep(term)
+	return err
+}
+
+// drainUnsupported reports whether a Drain error means the port can't
+// drain, rather than that it failed: tcdrain on a pty or socket fails with
+// ENOTTY, EINVAL or EOPNOTSUPP, and libserialport reports its own lack of
+// support as "not supported".
+func drainUnsupported(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.ENOTTY, syscall.EINVAL, syscall.ENOTSUP, syscall.EOPNOTSUPP} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not supported") || strings.Contains(msg, "unsupported")
+}
+
+// MeasureLatency times samples Pings, each a one byte command and its
+// reply, and returns the median and the slowest round trip. The device
+// answers in microseconds; what's measured is almost all USB transfer
+// scheduling and OS latency, e.g. the FTDI latency timer on a v3. Every
+// exchange that waits for a reply pays this once, so SpiSend costs a
+// round trip per byte, and moving data with the write then read commands,
+// which pay it a few times per transfer, is the way to go faster.
+func (bp *BusPirate) MeasureLatency(samples int) (median, max time.Duration, err error) {
+	if samples < 1 {
+		return 0, 0, fmt.Errorf("error, latency samples must be at least 1, got %d", samples)
+	}
+	times := make([]time.Duration, samples)
+	for i := range times {
+		start := time.Now()
+		if err := bp.Ping(); err != nil {
+			return 0, 0, err
+		}
+		times[i] = time.Since(start)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2], times[len(times)-1], nil
+}
@@ -0,0 +1,151 @@
+package buspirate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestChunkedReplies(t *testing.T) {
+	// the target answers with a count, so a lost or reordered byte shows
+	want := make([]byte, 300)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	readCount := func(bp *BusPirate) error {
+		in := make([]byte, len(want))
+		if err := bp.SpiWriteRead([]byte{0x03}, in); err != nil {
+			return err
+		}
+		if !bytes.Equal(in, want) {
+			return fmt.Errorf("read % x, want % x", in, want)
+		}
+		return nil
+	}
+	for _, tc := range []struct {
+		name  string
+		chunk int
+		mode  Mode
+		run   func(bp *BusPirate) error
+	}{
+		{"spi in-data 1 byte", 1, ModeSpi, readCount},
+		{"spi in-data 7 bytes", 7, ModeSpi, readCount},
+		{"spi banner 1 byte", 1, ModeBitbang, func(bp *BusPirate) error {
+			return bp.SpiEnter()
+		}},
+		{"spi banner split", 3, ModeBitbang, func(bp *BusPirate) error {
+			return bp.SpiEnter()
+		}},
+		{"bitbang banner split", 2, ModeSpi, func(bp *BusPirate) error {
+			return bp.ToBitbang()
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			var bp *BusPirate
+			if tc.mode == ModeSpi {
+				bp = fakeSpi(t, f)
+			} else {
+				bp = fakeBitbang(t, f)
+			}
+			var count byte
+			f.target = func(mosi byte) byte {
+				if mosi != 0xFF {
+					return 0
+				}
+				count++
+				return count - 1
+			}
+			f.chunk = tc.chunk
+			if err := tc.run(bp); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		timeout      time.Duration
+		setup        func(f *fakePort)
+		fails        bool
+		disconnected bool
+	}{
+		{"closed", 300 * time.Millisecond, func(f *fakePort) { f.Close() }, true, true},
+		{"hung up", 300 * time.Millisecond, func(f *fakePort) { f.hungUp = true }, true, true},
+		// a reply later than half the timeout is slow, not gone
+		{"slow", 300 * time.Millisecond, func(f *fakePort) { f.delay = 200 * time.Millisecond }, false, false},
+		{"silent", 300 * time.Millisecond, func(f *fakePort) { f.once = map[byte][]byte{modeVersionCmd: nil} }, true, false},
+		// a port cutting a wait short is a timeout, not a hangup
+		{"early return", 300 * time.Millisecond, func(f *fakePort) { f.mute, f.early = true, 5*time.Millisecond }, true, false},
+		{"hung up, short timeout", 50 * time.Millisecond, func(f *fakePort) { f.hungUp = true }, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			bp := fakeSpi(t, f, WithModeTimeout(ModeSpi, tc.timeout))
+			tc.setup(f)
+			err := bp.Ping()
+			if (err != nil) != tc.fails {
+				t.Fatalf("Ping error %v, want failure %v", err, tc.fails)
+			}
+			if got := errors.Is(err, ErrDeviceDisconnected); got != tc.disconnected {
+				t.Fatalf("Ping error %v, disconnected %v, want %v", err, got, tc.disconnected)
+			}
+			if tc.fails && !tc.disconnected && !errors.Is(err, ErrTimeout) {
+				t.Fatalf("Ping error %v, want ErrTimeout", err)
+			}
+		})
+	}
+}
+
+func TestDrainFallback(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tc := range []struct {
+		name     string
+		err      error
+		fallback bool
+	}{
+		{"ok", nil, false},
+		{"not supported", errors.New("sp_drain: Operation not supported"), true},
+		{"enotty", fmt.Errorf("drain: %w", syscall.ENOTTY), true},
+		{"failed", errors.New("drain failed"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logged.Reset()
+			f := newFakePort()
+			bp := fakeBitbang(t, f)
+			f.drainErr = tc.err
+			for i := 0; i < 2; i++ {
+				start := time.Now()
+				err := bp.drain()
+				if tc.fallback {
+					if err != nil {
+						t.Fatalf("drain: %v, want the fallback", err)
+					}
+					if d := time.Since(start); d < drainFallback {
+						t.Fatalf("drain took %v, want the %v fallback", d, drainFallback)
+					}
+				} else if err != tc.err {
+					t.Fatalf("drain: %v, want %v", err, tc.err)
+				}
+			}
+			want := 0
+			if tc.fallback {
+				want = 1
+			}
+			if n := strings.Count(logged.String(), "drain not supported"); n != want {
+				t.Fatalf("fallback logged %d times, want %d: %q", n, want, logged.String())
+			}
+		})
+	}
+}
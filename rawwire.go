@@ -0,0 +1,92 @@
+package buspirate
+
+const (
+	rawMode      = 0x05
+	rawReadBit   = 0x07
+	rawPeekInput = 0x08
+	rawClockTick = 0x09
+	rawDataLow   = 0x0C
+	rawDataHigh  = 0x0D
+)
+
+// Raw-wire mode pins: CLK is the clock. In 2-wire configuration, the
+// default, MOSI is the bidirectional data line; in 3-wire configuration
+// MOSI is data out and MISO data in. CS is the chip select.
+
+// RawEnter enters binary raw-wire mode.
+func (bp *BusPirate) RawEnter() error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
+	if n, err := bp.write([]byte{rawMode}, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing enter raw-wire mode, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if n, err := bp.readFull(reply, bp.cmdTimeout()); err != nil || string(reply) != "RAW1" {
+		err = bp.cmdError("error reading enter raw-wire mode, n: %d, %w", n, replyErr(n, err))
+		bp.flushInput()
+		return err
+	}
+	bp.mode = ModeRawWire
+	return nil
+}
+
+// RawLeave exits raw-wire mode, returning to bitbang mode.
+func (bp *BusPirate) RawLeave() error {
+	return bp.BitbangEnter()
+}
+
+// RawWriteBit sets the data line to bit and clocks it out with one clock
+// tick.
+func (bp *BusPirate) RawWriteBit(bit bool) error {
+	if err := bp.checkMode(ModeRawWire); err != nil {
+		return err
+	}
+	cmd := byte(rawDataLow)
+	if bit {
+		cmd = rawDataHigh
+	}
+	if err := bp.writeCmd(cmd, "raw-wire data"); err != nil {
+		return err
+	}
+	return bp.writeCmd(rawClockTick, "raw-wire clock tick")
+}
+
+// RawReadBit clocks in one bit from the data line.
+func (bp *BusPirate) RawReadBit() (bool, error) {
+	return bp.rawRead(rawReadBit, "raw-wire read bit")
+}
+
+// RawClockTick sends one clock pulse, leaving the data line as it is.
+func (bp *BusPirate) RawClockTick() error {
+	if err := bp.checkMode(ModeRawWire); err != nil {
+		return err
+	}
+	return bp.writeCmd(rawClockTick, "raw-wire clock tick")
+}
+
+// RawReadDataPin reads the level of the data input pin without clocking.
+func (bp *BusPirate) RawReadDataPin() (bool, error) {
+	return bp.rawRead(rawPeekInput, "raw-wire peek input")
+}
+
+// rawRead sends a raw-wire command answered with a 0x00 or 0x01 level.
+func (bp *BusPirate) rawRead(cmd byte, what string) (bool, error) {
+	if err := bp.checkMode(ModeRawWire); err != nil {
+		return false, err
+	}
+	buf := []byte{cmd}
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return false, bp.cmdError("error writing %s, n: %d, %w", what, n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return false, err
+	}
+	if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] > 0x01 {
+		return false, bp.cmdError("error reading %s reply, n: %d, %w", what, n, replyErr(n, err))
+	}
+	return buf[0] == 0x01, nil
+}
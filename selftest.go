@@ -0,0 +1,124 @@
+package buspirate
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SelfTestCheck is one check of the self-test.
+type SelfTestCheck struct {
+	// Name is the check as the device names it, prefixed with its section
+	// where the name alone is ambiguous, e.g. "Bus Hi-Z 0 MOSI".
+	Name string
+	Pass bool
+
+	// Value is the measured voltage for the supply and ADC checks, with
+	// HasValue set.
+	Value    float64
+	HasValue bool
+}
+
+// SelfTestResult is the outcome of SelfTest.
+type SelfTestResult struct {
+	Checks []SelfTestCheck
+	Errors int    // as counted by the device
+	Raw    string // the device's output
+}
+
+// Failed returns the checks that failed.
+func (r SelfTestResult) Failed() []SelfTestCheck {
+	var failed []SelfTestCheck
+	for _, c := range r.Checks {
+		if !c.Pass {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+var (
+	selfTestCheckLine = regexp.MustCompile(`^(.*?)(?:\(([0-9.]+)\))?\s+(OK|FAIL)$`)
+	selfTestErrors    = regexp.MustCompile(`Found ([0-9]+) errors?`)
+)
+
+// SelfTest runs the device's self-test and reports each check. It needs
+// the self-test jumpers as for the text-mode '~' command: nothing else
+// attached, Vpu to +5V and ADC to +3.3V. The binary mode self-test only
+// returns an error count, so the text-mode one is run: the device is reset
+// to text mode, leaving any protocol mode, and the session continues in
+// bitbang mode.
+func (bp *BusPirate) SelfTest() (SelfTestResult, error) {
+	var res SelfTestResult
+	err := bp.withTextMode(func() error {
+		var out bytes.Buffer
+		bp.discardInput()
+		if n, err := bp.write([]byte("~\n"), writeTimeout); n == 0 || err != nil {
+			return bp.cmdError("error writing self-test command, n: %d, %w", n, timeoutErr(n, err))
+		}
+		if err := bp.drain(); err != nil {
+			return err
+		}
+		// the device waits for a key before starting, and again before
+		// returning to the prompt
+		for _, wait := range []string{"Space to continue", "Any key to exit"} {
+			s, err := bp.readUntil(wait, 10*time.Second)
+			out.WriteString(s)
+			if err != nil {
+				res.Raw = out.String()
+				return fmt.Errorf("error reading self-test output, %w", err)
+			}
+			if n, err := bp.write([]byte(" "), writeTimeout); n == 0 || err != nil {
+				return bp.cmdError("error writing self-test key, n: %d, %w", n, timeoutErr(n, err))
+			}
+			if err := bp.drain(); err != nil {
+				return err
+			}
+		}
+		s, err := bp.readPrompt(2 * time.Second)
+		out.WriteString(s)
+		res = ParseSelfTest(out.String())
+		return err
+	})
+	return res, err
+}
+
+// ParseSelfTest parses the output of the text-mode '~' self-test. Lines
+// other than checks and the error count, e.g. the section headings, which
+// are used to disambiguate the check names, and instructions, are skipped.
+func ParseSelfTest(out string) SelfTestResult {
+	res := SelfTestResult{Raw: out, Errors: -1}
+	section := ""
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if m := selfTestErrors.FindStringSubmatch(line); m != nil {
+			res.Errors, _ = strconv.Atoi(m[1])
+			continue
+		}
+		m := selfTestCheckLine.FindStringSubmatch(line)
+		if m == nil {
+			// checks follow their section heading, e.g. "Bus high"
+			section = line
+			continue
+		}
+		c := SelfTestCheck{Name: strings.TrimSpace(m[1]), Pass: m[3] == "OK"}
+		if strings.HasPrefix(section, "Bus") {
+			c.Name = section + " " + c.Name
+		}
+		if m[2] != "" {
+			c.Value, _ = strconv.ParseFloat(m[2], 64)
+			c.HasValue = true
+		}
+		res.Checks = append(res.Checks, c)
+	}
+	if res.Errors < 0 {
+		res.Errors = len(res.Failed())
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+package buspirate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// selfTestPass is the '~' output of a v3 with the self-test jumpers fitted.
+const selfTestPass = `~
+Disconnect any devices
+Connect (Vpu to +5V) and (ADC to +3.3V)
+Space to continue
+Ctrl
+AUX OK
+MODE LED OK
+PULLUP H OK
+PULLUP L OK
+VREG OK
+ADC and supply
+5V(5.02) OK
+VPU(5.00) OK
+3.3V(3.29) OK
+ADC(3.29) OK
+Bus high
+MOSI OK
+CLK OK
+MISO OK
+CS OK
+Bus Hi-Z 0
+MOSI OK
+CLK OK
+MISO OK
+CS OK
+Bus Hi-Z 1
+MOSI OK
+CLK OK
+MISO OK
+CS OK
+MODE and VREG LEDs should be on!
+Any key to exit
+Found 0 errors.
+HiZ>`
+
+func TestParseSelfTest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		out    string
+		checks int
+		errors int
+		failed []SelfTestCheck
+	}{
+		{"pass", selfTestPass, 21, 0, nil},
+		{"crlf", strings.ReplaceAll(selfTestPass, "\n", "\r\n"), 21, 0, nil},
+		{"vpu unjumpered", strings.Replace(
+			strings.Replace(selfTestPass, "VPU(5.00) OK", "VPU(0.00) FAIL", 1),
+			"Found 0 errors.", "Found 1 error.", 1), 21, 1,
+			[]SelfTestCheck{{Name: "VPU", Value: 0, HasValue: true}}},
+		{"pullup", strings.Replace(
+			strings.Replace(selfTestPass, "PULLUP H OK", "PULLUP H FAIL", 1),
+			"Found 0 errors.", "Found 1 error.", 1), 21, 1,
+			[]SelfTestCheck{{Name: "PULLUP H"}}},
+		{"bus pin", strings.Replace(
+			strings.Replace(selfTestPass, "Bus Hi-Z 0\nMOSI OK", "Bus Hi-Z 0\nMOSI FAIL", 1),
+			"Found 0 errors.", "Found 1 error.", 1), 21, 1,
+			[]SelfTestCheck{{Name: "Bus Hi-Z 0 MOSI"}}},
+		// cut off mid line, without the count: the errors are the failed
+		// checks read
+		{"truncated", selfTestPass[:strings.Index(selfTestPass, "3.3V(3.29) OK")+4], 7, 0, nil},
+		{"truncated after a failure", strings.Replace(
+			selfTestPass[:strings.Index(selfTestPass, "Bus high")], "VPU(5.00) OK", "VPU(1.20) FAIL", 1), 9, 1,
+			[]SelfTestCheck{{Name: "VPU", Value: 1.2, HasValue: true}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res := ParseSelfTest(tc.out)
+			if len(res.Checks) != tc.checks {
+				t.Fatalf("%d checks, want %d: %+v", len(res.Checks), tc.checks, res.Checks)
+			}
+			if res.Errors != tc.errors {
+				t.Fatalf("%d errors, want %d", res.Errors, tc.errors)
+			}
+			if failed := res.Failed(); !reflect.DeepEqual(failed, tc.failed) {
+				t.Fatalf("failed %+v, want %+v", failed, tc.failed)
+			}
+			if res.Raw != tc.out {
+				t.Fatal("Raw is not the output parsed")
+			}
+		})
+	}
+
+	res := ParseSelfTest(selfTestPass)
+	want := SelfTestCheck{Name: "5V", Pass: true, Value: 5.02, HasValue: true}
+	if res.Checks[5] != want {
+		t.Fatalf("check %+v, want %+v", res.Checks[5], want)
+	}
+	if name := res.Checks[len(res.Checks)-1].Name; name != "Bus Hi-Z 1 CS" {
+		t.Fatalf("last check %q, want Bus Hi-Z 1 CS", name)
+	}
+}
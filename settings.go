@@ -0,0 +1,104 @@
+package buspirate
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Settings returns the configuration the firmware reports, parsed by
+// ParseSettings, and the raw lines it came from. No firmware has a command
+// to dump stored settings: the v3 has no EEPROM and keeps nothing across a
+// power cycle, and the v4 doesn't expose what it keeps in its EEPROM. What
+// can be read is the info banner's report of the current mode settings, so
+// the device is reset to text mode to issue 'i', as for DeviceInfo, which
+// leaves any protocol mode; the session continues in bitbang mode.
+func (bp *BusPirate) Settings() (settings map[string]string, raw []string, err error) {
+	info, err := bp.DeviceInfo()
+	if err != nil {
+		return nil, nil, err
+	}
+	settings, raw = ParseSettings(info)
+	return settings, raw, nil
+}
+
+// settingsRule is the "*----------*" rule around the settings block.
+var settingsRule = regexp.MustCompile(`^\*-+\*$`)
+
+// ParseSettings parses an info banner as returned by DeviceInfo into
+// settings, returning them with the non-empty lines of the banner. The
+// identification lines are keyed as the Version fields: "Hardware",
+// "Firmware", "Bootloader", "DevID", "RevID" and "PIC". Of the settings
+// lines, which vary between firmwares and modes,
+//
+//	Number of bits read/write: 8
+//	POWER SUPPLIES ON
+//	Open drain outputs (H=Hi-Z, L=GND)
+//
+// a "key: value" line gives its key and value, a line ending in ON or OFF
+// gives the rest of the line as key, and any other line is a flag, its
+// whole text the key and the value empty. Settings lines are taken from
+// between the "*----------*" rules if the banner has them, and otherwise
+// from every line after the identification.
+func ParseSettings(info string) (settings map[string]string, raw []string) {
+	settings = make(map[string]string)
+	v := ParseVersion(info)
+	for k, val := range map[string]string{
+		"Hardware":   v.Hardware,
+		"Firmware":   v.Firmware,
+		"Bootloader": v.Bootloader,
+		"DevID":      v.DevID,
+		"RevID":      v.RevID,
+		"PIC":        v.PIC,
+	} {
+		if val != "" {
+			settings[k] = val
+		}
+	}
+
+	var lines []string
+	rules := 0
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		raw = append(raw, line)
+		if settingsRule.MatchString(line) {
+			if rules++; rules == 1 {
+				lines = lines[:0]
+			}
+			continue
+		}
+		if rules == 1 || rules == 0 && !identLine(line) {
+			lines = append(lines, line)
+		}
+	}
+	// the prompt, if the banner was read up to it
+	if n := len(lines); n > 0 && rules < 2 && strings.HasSuffix(lines[n-1], ">") {
+		lines = lines[:n-1]
+	}
+
+	for _, line := range lines {
+		if i := strings.Index(line, ": "); i > 0 {
+			settings[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+2:])
+			continue
+		}
+		if i := strings.LastIndex(line, " "); i > 0 {
+			switch last := strings.ToUpper(line[i+1:]); last {
+			case "ON", "OFF":
+				settings[strings.TrimSpace(line[:i])] = last
+				continue
+			}
+		}
+		settings[line] = ""
+	}
+	return settings, raw
+}
+
+// identLine reports whether line is one ParseVersion reads, the echoed
+// command, or the URL that follows the identification.
+func identLine(line string) bool {
+	return line == "i" || strings.HasPrefix(line, "Bus Pirate") ||
+		strings.Contains(line, "Firmware") || strings.Contains(line, "Bootloader") ||
+		strings.HasPrefix(line, "DEVID") || strings.HasPrefix(line, "http")
+}
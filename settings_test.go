@@ -0,0 +1,85 @@
+package buspirate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// settingsI2c is the 'i' output of a v3 on v5.10 firmware in I2C mode.
+const settingsI2c = `i
+Bus Pirate v3.b
+Firmware v5.10 (r559)  Bootloader v4.4
+DEVID:0x0447 REVID:0x3046 (24FJ64GA002 B8)
+http://dangerousprototypes.com
+CFG1:0xFFDF CFG2:0xFF7F
+*----------*
+Pinstates:
+1.(BR)  2.(RD)  3.(OR)  4.(YW)  5.(GN)  6.(BL)  7.(PU)  8.(GR)  9.(WT)  0.(Blk)
+GND     3.3V    5.0V    ADC     VPU     AUX     SCL     SDA     -       -
+MSB set: MSB first
+POWER SUPPLIES ON
+Pull-up resistors off
+A/D, PWM, and SERVO are disabled
+*----------*
+I2C>`
+
+// settingsOld is the 'i' output of older firmware, with no rules around the
+// settings.
+const settingsOld = "Bus Pirate v3a\r\nFirmware v4.2 Bootloader v4.1\r\nDEVID:0x0447 REVID:0x3043 (B5)\r\nhttp://dangerousprototypes.com\r\n\r\nNumber of bits read/write: 8\r\nPOWER SUPPLIES OFF\r\nHiZ>"
+
+func TestParseSettings(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		info string
+		want map[string]string
+		raw  int
+	}{
+		{"ruled", settingsI2c, map[string]string{
+			"Hardware":   "Bus Pirate v3.b",
+			"Firmware":   "v5.10 (r559)",
+			"Bootloader": "v4.4",
+			"DevID":      "0x0447",
+			"RevID":      "0x3046",
+			"PIC":        "24FJ64GA002 B8",
+			"Pinstates:": "",
+			"1.(BR)  2.(RD)  3.(OR)  4.(YW)  5.(GN)  6.(BL)  7.(PU)  8.(GR)  9.(WT)  0.(Blk)": "",
+			"GND     3.3V    5.0V    ADC     VPU     AUX     SCL     SDA     -       -":       "",
+			"MSB set":                          "MSB first",
+			"POWER SUPPLIES":                   "ON",
+			"Pull-up resistors":                "OFF",
+			"A/D, PWM, and SERVO are disabled": "",
+		}, 16},
+		{"unruled", settingsOld, map[string]string{
+			"Hardware":                  "Bus Pirate v3a",
+			"Firmware":                  "v4.2",
+			"Bootloader":                "v4.1",
+			"DevID":                     "0x0447",
+			"RevID":                     "0x3043",
+			"PIC":                       "B5",
+			"Number of bits read/write": "8",
+			"POWER SUPPLIES":            "OFF",
+		}, 7},
+		{"empty", "", map[string]string{}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			settings, raw := ParseSettings(tc.info)
+			if !reflect.DeepEqual(settings, tc.want) {
+				t.Fatalf("settings %q, want %q", settings, tc.want)
+			}
+			// raw is every non-empty line, trimmed, identification,
+			// rules and prompt included
+			if len(raw) != tc.raw {
+				t.Fatalf("%d raw lines, want %d: %q", len(raw), tc.raw, raw)
+			}
+			for _, line := range raw {
+				if line == "" || line != strings.TrimSpace(line) {
+					t.Fatalf("raw line %q is empty or untrimmed", line)
+				}
+				if !strings.Contains(tc.info, line) {
+					t.Fatalf("raw line %q is not in the banner", line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package buspirate
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// smbusBlockMax is the largest SMBus 2.0 block.
+const smbusBlockMax = 32
+
+// I2cQuick sends an SMBus Quick Command to the 7 bit address addr: start,
+// the address with read as its R/W bit, and stop, with no data. The R/W
+// bit is the command's one bit of data, which devices that take quick
+// commands use as a switch, e.g. on or off, or standby; a device's
+// datasheet says which is which. The device acknowledging its address is
+// the only reply: I2cQuick returns nil if it did and an *I2cNakError, with
+// Index 0, if it didn't, after the stop has been sent either way.
+//
+// A quick read addresses the device for reading but reads nothing, which
+// SMBus devices expect; a plain I2C device may start sending its first bit
+// and hold SDA low, so the stop can't be sent, and needs I2cRecoverBus.
+func (bp *BusPirate) I2cQuick(addr byte, read bool) error {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return err
+	}
+	if err := bp.I2cStart(); err != nil {
+		return err
+	}
+	a := addr << 1
+	if read {
+		a |= 0x01
+	}
+	nak, err := bp.i2cBulkWrite([]byte{a}, bp.cmdTimeout())
+	if err != nil {
+		return err
+	}
+	if err := bp.I2cStop(); err != nil {
+		return err
+	}
+	if nak >= 0 {
+		return &I2cNakError{Index: nak}
+	}
+	return nil
+}
+
+// I2cReadLengthPrefixed reads a length prefixed block from the 7 bit
+// address addr, as SMBus block reads return it: start, address (read), a
+// count byte, then count data bytes, the last one NAKed, and stop. Only
+// the data bytes are returned. This is the read phase of the SMBus Block
+// Read protocol, whose command code write comes first, for devices that
+// answer a plain read with a block.
+//
+// A count over the SMBus 2.0 limit of 32 bytes, or of 0, isn't read: the
+// count byte is NAKed and the transaction stopped with an error, as the
+// device is then out of step or not an SMBus block device.
+func (bp *BusPirate) I2cReadLengthPrefixed(addr byte) ([]byte, error) {
+	if err := bp.checkMode(ModeI2c); err != nil {
+		return nil, err
+	}
+	if err := bp.I2cStart(); err != nil {
+		return nil, err
+	}
+	return bp.i2cReadBlock(addr, bp.cmdTimeout())
+}
+
+// i2cReadBlock addresses addr for reading, after a start has been sent,
+// reads a count byte and count data bytes, and sends the stop.
+func (bp *BusPirate) i2cReadBlock(addr byte, timeout time.Duration) ([]byte, error) {
+	nak, err := bp.i2cBulkWrite([]byte{addr<<1 | 0x01}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if nak >= 0 {
+		bp.I2cStop()
+		return nil, &I2cNakError{Index: 0}
+	}
+	count, err := bp.i2cCmd(i2cReadByte, "i2c read byte", timeout)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 || count > smbusBlockMax {
+		err := bp.i2cStep(i2cNak, "i2c nak", timeout)
+		bp.I2cStop()
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error, invalid i2c block length: %d, must be 1-%d", count, smbusBlockMax)
+	}
+	if err := bp.i2cStep(i2cAck, "i2c ack", timeout); err != nil {
+		return nil, err
+	}
+	data := make([]byte, count)
+	for i := range data {
+		if data[i], err = bp.i2cCmd(i2cReadByte, "i2c read byte", timeout); err != nil {
+			return nil, err
+		}
+		ack := byte(i2cAck)
+		if i == len(data)-1 {
+			ack = i2cNak
+		}
+		if err := bp.i2cStep(ack, "i2c ack", timeout); err != nil {
+			return nil, err
+		}
+	}
+	if err := bp.i2cStep(i2cStop, "i2c stop", timeout); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ErrPECMismatch is returned when the SMBus PEC byte read back doesn't
+// match the one computed over the transaction.
+var ErrPECMismatch = errors.New("error, smbus pec mismatch")
+
+// SMBusPEC returns the SMBus packet error code of data: the CRC-8 with
+// polynomial x^8 + x^2 + x + 1 (0x07), initial value 0, no reflection and
+// no final XOR. Over a transaction, data is every byte on the bus in
+// order, including the address bytes with their R/W bit.
+func SMBusPEC(data []byte) byte {
+	crc := byte(0)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// I2cTransferPEC is I2cTransfer with SMBus packet error checking, for
+// devices that use it: the PEC byte is appended to the write when there's
+// no read phase, and otherwise read after the readLen data bytes and
+// checked, failing with ErrPECMismatch if it doesn't match. Either way the
+// PEC covers the whole transaction, address bytes included.
+func (bp *BusPirate) I2cTransferPEC(addr byte, write []byte, readLen int, timeout time.Duration) ([]byte, error) {
+	if readLen < 0 {
+		return nil, fmt.Errorf("error, invalid i2c transfer read length: %d", readLen)
+	}
+	msg := append([]byte{addr << 1}, write...)
+	if readLen == 0 {
+		_, err := bp.I2cTransfer(addr, append(write[:len(write):len(write)], SMBusPEC(msg)), 0, timeout)
+		return nil, err
+	}
+	in, err := bp.I2cTransfer(addr, write, readLen+1, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(write) == 0 {
+		msg = msg[:0]
+	}
+	msg = append(msg, addr<<1|0x01)
+	msg = append(msg, in[:readLen]...)
+	if pec := SMBusPEC(msg); in[readLen] != pec {
+		return nil, fmt.Errorf("%w, read 0x%02x, computed 0x%02x", ErrPECMismatch, in[readLen], pec)
+	}
+	return in[:readLen], nil
+}
+
+// smbusTransfer is I2cTransfer for the SMBus transactions, with PEC as
+// I2cTransferPEC adds it if pec is set.
+func (bp *BusPirate) smbusTransfer(addr byte, write []byte, readLen int, pec bool) ([]byte, error) {
+	if pec {
+		return bp.I2cTransferPEC(addr, write, readLen, bp.cmdTimeout())
+	}
+	return bp.I2cTransfer(addr, write, readLen, bp.cmdTimeout())
+}
+
+// The SMBus transactions below address the 7 bit address addr with the
+// command code cmd, the register or function of the device. As the SMBus
+// specification has it, words go over the bus low byte first: 0x1234 is
+// sent, or read, as 0x34 then 0x12. This is the opposite of the big endian
+// register values many plain I2C devices use, whose 16 bit registers need
+// I2cTransfer instead. Each has a PEC variant for devices that use packet
+// error checking, which fails a read with ErrPECMismatch; a device that
+// doesn't use PEC NAKs the extra byte of a write.
+
+// SMBusReadByte performs an SMBus Read Byte: start, address (write), cmd,
+// repeated start, address (read), the data byte NAKed, stop.
+func (bp *BusPirate) SMBusReadByte(addr, cmd byte) (byte, error) {
+	return bp.smbusReadByte(addr, cmd, false)
+}
+
+// SMBusReadBytePEC is SMBusReadByte with PEC.
+func (bp *BusPirate) SMBusReadBytePEC(addr, cmd byte) (byte, error) {
+	return bp.smbusReadByte(addr, cmd, true)
+}
+
+func (bp *BusPirate) smbusReadByte(addr, cmd byte, pec bool) (byte, error) {
+	in, err := bp.smbusTransfer(addr, []byte{cmd}, 1, pec)
+	if err != nil {
+		return 0, err
+	}
+	return in[0], nil
+}
+
+// SMBusWriteByte performs an SMBus Write Byte: start, address (write), cmd,
+// value, stop.
+func (bp *BusPirate) SMBusWriteByte(addr, cmd, value byte) error {
+	_, err := bp.smbusTransfer(addr, []byte{cmd, value}, 0, false)
+	return err
+}
+
+// SMBusWriteBytePEC is SMBusWriteByte with PEC.
+func (bp *BusPirate) SMBusWriteBytePEC(addr, cmd, value byte) error {
+	_, err := bp.smbusTransfer(addr, []byte{cmd, value}, 0, true)
+	return err
+}
+
+// SMBusReadWord performs an SMBus Read Word: as SMBusReadByte, with two data
+// bytes read, low byte first.
+func (bp *BusPirate) SMBusReadWord(addr, cmd byte) (uint16, error) {
+	return bp.smbusReadWord(addr, cmd, false)
+}
+
+// SMBusReadWordPEC is SMBusReadWord with PEC.
+func (bp *BusPirate) SMBusReadWordPEC(addr, cmd byte) (uint16, error) {
+	return bp.smbusReadWord(addr, cmd, true)
+}
+
+func (bp *BusPirate) smbusReadWord(addr, cmd byte, pec bool) (uint16, error) {
+	in, err := bp.smbusTransfer(addr, []byte{cmd}, 2, pec)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(in[0]) | uint16(in[1])<<8, nil
+}
+
+// SMBusWriteWord performs an SMBus Write Word: as SMBusWriteByte, with value
+// sent as two data bytes, low byte first.
+func (bp *BusPirate) SMBusWriteWord(addr, cmd byte, value uint16) error {
+	_, err := bp.smbusTransfer(addr, []byte{cmd, byte(value), byte(value >> 8)}, 0, false)
+	return err
+}
+
+// SMBusWriteWordPEC is SMBusWriteWord with PEC.
+func (bp *BusPirate) SMBusWriteWordPEC(addr, cmd byte, value uint16) error {
+	_, err := bp.smbusTransfer(addr, []byte{cmd, byte(value), byte(value >> 8)}, 0, true)
+	return err
+}
@@ -0,0 +1,119 @@
+package buspirate
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSMBusPEC(t *testing.T) {
+	for _, tc := range []struct {
+		data []byte
+		pec  byte
+	}{
+		{nil, 0x00},
+		{[]byte("123456789"), 0xF4}, // the CRC-8/SMBUS check value
+		{[]byte{0x01}, 0x07},
+	} {
+		if got := SMBusPEC(tc.data); got != tc.pec {
+			t.Errorf("SMBusPEC(% x) = 0x%02x, want 0x%02x", tc.data, got, tc.pec)
+		}
+	}
+}
+
+func TestI2cTransferPECWrite(t *testing.T) {
+	f := newFakePort()
+	bp := fakeI2c(t, f)
+	write := []byte{0x10, 0x55}
+	if _, err := bp.I2cTransferPEC(fakeI2cAddr, write, 0, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte{0xA0, 0x10, 0x55}
+	want := append(msg, SMBusPEC(msg))
+	if !bytes.Equal(f.i2cBus, want) {
+		t.Fatalf("bus got % x, want % x", f.i2cBus, want)
+	}
+	if !bytes.Equal(write, []byte{0x10, 0x55}) {
+		t.Fatalf("write changed to % x", write)
+	}
+}
+
+func TestI2cTransferPECRead(t *testing.T) {
+	data := []byte{0x34, 0x12}
+	for _, tc := range []struct {
+		name  string
+		write []byte
+		// the bytes the PEC covers: both address bytes with a repeated
+		// start, only the read address without a write phase
+		msg []byte
+		bad bool
+	}{
+		{"repeated start", []byte{0x10}, []byte{0xA0, 0x10, 0xA1, 0x34, 0x12}, false},
+		{"read only", nil, []byte{0xA1, 0x34, 0x12}, false},
+		{"mismatch", []byte{0x10}, []byte{0xA0, 0x10, 0xA1, 0x34, 0x12}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			bp := fakeI2c(t, f)
+			pec := SMBusPEC(tc.msg)
+			if tc.bad {
+				pec ^= 0x01
+			}
+			f.i2cRead = append(append([]byte(nil), data...), pec)
+			in, err := bp.I2cTransferPEC(fakeI2cAddr, tc.write, len(data), time.Second)
+			if tc.bad {
+				if !errors.Is(err, ErrPECMismatch) {
+					t.Fatalf("I2cTransferPEC: %v, want ErrPECMismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(in, data) {
+				t.Fatalf("read % x, want % x", in, data)
+			}
+			if len(f.i2cRead) != 0 {
+				t.Fatalf("PEC byte not read, % x left", f.i2cRead)
+			}
+		})
+	}
+}
+
+func TestI2cReadLengthPrefixed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		read []byte
+		once map[byte][]byte
+		want []byte
+		err  string
+	}{
+		{"block", []byte{2, 0xAA, 0xBB}, nil, []byte{0xAA, 0xBB}, ""},
+		{"zero count", []byte{0}, nil, nil, "block length"},
+		{"over 32", []byte{33}, nil, nil, "block length"},
+		{"bad nak reply", []byte{0}, map[byte][]byte{i2cNak: {0x42}}, nil, "i2c nak"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			bp := fakeI2c(t, f)
+			f.i2cRead = tc.read
+			f.once = tc.once
+			data, err := bp.I2cReadLengthPrefixed(fakeI2cAddr)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, tc.want) {
+					t.Fatalf("read % x, want % x", data, tc.want)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("I2cReadLengthPrefixed: %v, want a %s error", err, tc.err)
+			}
+			if w := f.sent(); w[len(w)-1] != i2cStop {
+				t.Fatalf("wrote % x, want a stop last", w)
+			}
+		})
+	}
+}
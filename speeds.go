@@ -0,0 +1,168 @@
+package buspirate
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Speeds lists bus speeds in Hz, or baud for the UART, in the order the
+// firmware offers them.
+type Speeds struct {
+	Spi  []int
+	I2c  []int
+	Uart []int
+
+	// FromDevice is set when every list was read from the device's menus,
+	// and cleared when any is the v3 firmware table SupportedSpeeds falls
+	// back on.
+	FromDevice bool
+}
+
+var uartSpeedHz = [...]int{300, 1200, 2400, 4800, 9600, 19200, 31250, 38400, 57600, 115200}
+
+// v3Speeds returns the speeds of the v3 firmware's binary protocol, those
+// of the SpiSpeed, I2cSpeed and UartSpeed constants.
+func v3Speeds() Speeds {
+	return Speeds{
+		Spi:  append([]int(nil), spiSpeedHz[:]...),
+		I2c:  append([]int(nil), i2cSpeedHz[:I2cSpeed400khz+1]...),
+		Uart: append([]int(nil), uartSpeedHz[:]...),
+	}
+}
+
+// SupportedSpeeds reads the SPI, I2C and UART speed menus of the firmware,
+// for tools presenting the choices a board actually offers: clone and
+// community firmwares don't all offer the same set. Each mode is set up in
+// text mode as far as its speed menu, the remaining prompts are answered
+// with their defaults, and the device is returned to HiZ; any protocol
+// mode is left and the session continues in bitbang mode. For I2C the
+// software implementation's speeds are read, those of the binary mode.
+//
+// A menu that can't be found or parsed is replaced by the v3 firmware
+// table, the speeds of the SpiSpeed, I2cSpeed and UartSpeed constants, as
+// is every menu after an I/O error, which is returned. Menus list speeds
+// the text mode offers; the binary speed commands still only take the
+// speed constants.
+func (bp *BusPirate) SupportedSpeeds() (Speeds, error) {
+	s := Speeds{FromDevice: true}
+	err := bp.withTextMode(func() error {
+		for _, m := range []struct {
+			name string
+			hz   *[]int
+		}{{"SPI", &s.Spi}, {"I2C", &s.I2c}, {"UART", &s.Uart}} {
+			hz, err := bp.menuSpeeds(m.name)
+			if err != nil {
+				return err
+			}
+			*m.hz = hz
+		}
+		return nil
+	})
+	v3 := v3Speeds()
+	if err != nil {
+		return v3, err
+	}
+	for _, f := range []struct{ got, v3 *[]int }{{&s.Spi, &v3.Spi}, {&s.I2c, &v3.I2c}, {&s.Uart, &v3.Uart}} {
+		if len(*f.got) == 0 {
+			*f.got = *f.v3
+			s.FromDevice = false
+		}
+	}
+	return s, nil
+}
+
+// speedMenuLine matches a speed menu entry, e.g. " 2. ~50KHz", "9. 115200"
+// or "6. 2.6MHz", but not "10. BRG raw value".
+var speedMenuLine = regexp.MustCompile(`(?im)^\s*\d+\.\s*~?([0-9]+(?:\.[0-9]+)?)\s*(k|m)?(?:hz)?\s*$`)
+
+// menuSpeeds selects the mode name from the text-mode 'm' menu, parses its
+// speed menu, and answers the prompts that follow with their defaults
+// before returning to HiZ. A menu that can't be parsed gives no speeds
+// and no error.
+func (bp *BusPirate) menuSpeeds(name string) ([]int, error) {
+	out, err := bp.textInput("m")
+	if err != nil {
+		return nil, err
+	}
+	m := regexp.MustCompile(`(?m)^\s*([0-9]+)\.\s*` + name + `\b`).FindStringSubmatch(out)
+	if m == nil {
+		return nil, bp.leaveMenu(out)
+	}
+	if out, err = bp.textInput(m[1]); err != nil {
+		return nil, err
+	}
+	if strings.Contains(out, "Software") && strings.Contains(out, "Hardware") {
+		// firmware with a hardware I2C option asks which first
+		if out, err = bp.textInput("1"); err != nil {
+			return nil, err
+		}
+	}
+	var hz []int
+	for _, e := range speedMenuLine.FindAllStringSubmatch(out, -1) {
+		v, err := strconv.ParseFloat(e[1], 64)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(e[2]) {
+		case "k":
+			v *= 1e3
+		case "m":
+			v *= 1e6
+		}
+		hz = append(hz, int(v))
+	}
+	return hz, bp.leaveMenu(out)
+}
+
+// leaveMenu answers the menu prompts following out, e.g. "(1)>", with
+// their defaults until a mode prompt is reached, and returns to HiZ.
+func (bp *BusPirate) leaveMenu(out string) error {
+	var err error
+	for i := 0; i < 10 && menuPrompt(out); i++ {
+		if out, err = bp.textInput(""); err != nil {
+			return err
+		}
+	}
+	if menuPrompt(out) {
+		return fmt.Errorf("error, text-mode menu didn't end: %q", lastLine(out))
+	}
+	if _, err := bp.textInput("m"); err != nil {
+		return err
+	}
+	// 1 is HiZ in every firmware's mode menu
+	_, err = bp.textInput("1")
+	return err
+}
+
+// textInput sends a line of text-mode input and returns the output, up to
+// and including the prompt that follows it.
+func (bp *BusPirate) textInput(line string) (string, error) {
+	if n, err := bp.write([]byte(line+"\n"), writeTimeout); n == 0 || err != nil {
+		return "", bp.cmdError("error writing text input %q, n: %d, %w", line, n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return "", err
+	}
+	out, err := bp.readPrompt(2 * time.Second)
+	if err != nil {
+		return "", bp.cmdError("error reading text input %q reply, %w", line, err)
+	}
+	return out, nil
+}
+
+// menuPrompt reports whether out ends in a menu prompt, "(1)>", rather than
+// a mode prompt, "SPI>".
+func menuPrompt(out string) bool {
+	return strings.HasPrefix(lastLine(out), "(")
+}
+
+func lastLine(out string) string {
+	out = strings.TrimSpace(out)
+	if i := strings.LastIndexAny(out, "\r\n"); i >= 0 {
+		out = out[i+1:]
+	}
+	return strings.TrimSpace(out)
+}
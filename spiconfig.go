@@ -0,0 +1,185 @@
+package buspirate
+
+import (
+	"fmt"
+)
+
+// SpiConfig is a complete SPI mode configuration, applied in one call by
+// SpiSetup. Start from DefaultSpiConfig rather than the zero value, which
+// has open drain outputs and an active high chip select.
+type SpiConfig struct {
+	Speed SpiSpeed
+
+	// Mode is the SPI mode, 0-3: CPOL is bit 1 and CPHA bit 0.
+	Mode int
+
+	// CSActiveLow selects the usual active low chip select.
+	CSActiveLow bool
+
+	// OutputPushPull drives the MOSI, CLK and CS outputs at 3.3v, which
+	// suits a target wired directly to the Bus Pirate. Otherwise the
+	// outputs are open drain (HiZ): they only pull low and need pullups,
+	// on-board (Pullups) or on the target, to reach the high level. A
+	// target that never responds is often one left on open drain outputs
+	// without pullups.
+	OutputPushPull bool
+
+	// SampleEnd samples MISO at the end of the data output time rather than
+	// the middle. Devices with a long clock to output delay, or long wires,
+	// may not have MISO settled by mid-bit; intermittent bit errors that
+	// go away at lower speeds are the usual sign this needs to be set.
+	SampleEnd bool
+
+	Power   bool // 5v and 3v3 supplies
+	Pullups bool // on-board pullups, fed by Vpu
+	Aux     bool // AUX pin high
+}
+
+// DefaultSpiConfig returns a 1MHz, mode 0, active low chip select
+// configuration with push-pull outputs, which works for most directly
+// connected devices.
+func DefaultSpiConfig() SpiConfig {
+	return SpiConfig{
+		Speed:          SpiSpeed1mhz,
+		CSActiveLow:    true,
+		OutputPushPull: true,
+	}
+}
+
+// Validate checks the configuration without touching the device.
+func (c SpiConfig) Validate() error {
+	if c.Speed > SpiSpeed8mhz {
+		return fmt.Errorf("error, invalid SpiConfig.Speed: %d", c.Speed)
+	}
+	if c.Mode < 0 || c.Mode > 3 {
+		return fmt.Errorf("error, invalid SpiConfig.Mode: %d, must be 0-3", c.Mode)
+	}
+	if c.Pullups && !c.Power {
+		return fmt.Errorf("error, SpiConfig.Pullups requires SpiConfig.Power to feed Vpu")
+	}
+	return nil
+}
+
+// cfgBits returns the SpiCfg idle (CKP) and edge (CKE) bits for the mode.
+// CPHA 0 samples on the leading edge, so the output changes on the active
+// to idle edge.
+func (c SpiConfig) cfgBits() (idle, edge bool) {
+	return c.Mode&0x02 != 0, c.Mode&0x01 == 0
+}
+
+// SpiSetup validates cfg and applies it in SPI mode: speed, bus
+// configuration and peripherals. Chip select is left deasserted.
+//
+// The four configuration commands are written together and their acks read
+// afterwards, one USB round trip rather than the four of the separate
+// setters, which is most of the setup time of a tool that reconnects
+// often. The firmware handles each command before reading the next, and
+// four bytes fit the v3's UART receive FIFO, so none are lost while one is
+// handled. If an ack is missing or wrong the error reports which command
+// failed; the settings acked before it are kept, as the setters would have
+// kept them, and any later replies are discarded.
+func (bp *BusPirate) SpiSetup(cfg SpiConfig) error {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	idle, edge := cfg.cfgBits()
+	cmds := []struct {
+		name  string
+		cmd   byte
+		store *byte
+	}{
+		{"spi speed", spiSpeedCfg | byte(cfg.Speed&0x07), &bp.spiSpeed},
+		{"spi cfg", spiCfg | cfgNibble(cfg.OutputPushPull, idle, edge, cfg.SampleEnd), &bp.spiCfg},
+		{"spi periph cfg", spiPeriphCfg | cfgNibble(cfg.Power, cfg.Pullups, cfg.Aux, cfg.CSActiveLow), &bp.periph},
+		{"set spi cs", spiCSState | cfgNibble(false, false, false, cfg.CSActiveLow), &bp.spiCS},
+	}
+	buf := make([]byte, len(cmds))
+	for i, c := range cmds {
+		buf[i] = c.cmd
+	}
+	if n, err := bp.write(buf, writeTimeout); n != len(buf) || err != nil {
+		if err == nil {
+			err = ErrTimeout
+		}
+		return bp.cmdError("error writing spi setup, n: %d, %w", n, err)
+	}
+	if err := bp.drain(); err != nil {
+		return err
+	}
+	n, err := bp.readFull(buf, bp.cmdTimeout())
+	for i, c := range cmds {
+		if i >= n || buf[i] != 0x01 {
+			cause := err
+			if i < n {
+				cause = errInvalidReply
+			}
+			err := bp.cmdError("error reading %s reply, ack %d of %d, %w", c.name, i+1, len(cmds), cause)
+			bp.flushInput()
+			return err
+		}
+		*c.store = c.cmd
+	}
+	// the polarity is set by the periph and CS commands, so it waits for
+	// both acks
+	bp.spiCSActiveHigh = !cfg.CSActiveLow
+	if err := bp.ackOnly("spi setup"); err != nil {
+		return err
+	}
+	if bp.periphVerify {
+		return bp.verifyPeriph(bp.spiReenter)
+	}
+	return nil
+}
+
+// cfgNibble packs the four flags of a configuration command, w first, into
+// its low bits, wxyz.
+func cfgNibble(w, x, y, z bool) byte {
+	var b byte
+	for _, f := range []bool{w, x, y, z} {
+		b <<= 1
+		if f {
+			b |= 1
+		}
+	}
+	return b
+}
+
+// SpiConn adapts a BusPirate in SPI mode to the Tx convention of
+// periph.io's spi.Conn, so drivers written against that interface can run
+// on the Bus Pirate. periph's Port.Connect settings map onto SpiConfig:
+// the clock onto Speed, which only has the SpiSpeed steps, and the mode
+// onto Mode; apply them with SpiSetup first. Only 8 bit words are
+// supported, and every Tx is framed by chip select.
+type SpiConn struct {
+	bp *BusPirate
+}
+
+// NewSpiConn returns an SpiConn using bp, which must already be in SPI mode
+// and configured.
+func NewSpiConn(bp *BusPirate) *SpiConn {
+	return &SpiConn{bp: bp}
+}
+
+// Tx exchanges w and r within one chip select window. With both non-empty
+// the exchange is full duplex and they must be the same length; with one
+// empty it's a write only or read only transfer.
+func (c *SpiConn) Tx(w, r []byte) error {
+	switch {
+	case len(r) == 0:
+		return c.bp.SpiWriteRead(w, nil)
+	case len(w) == 0:
+		return c.bp.SpiWriteRead(nil, r)
+	case len(w) != len(r):
+		return fmt.Errorf("%w: spi tx of %d bytes out and %d in, full duplex needs equal lengths", ErrUnsupported, len(w), len(r))
+	}
+	return c.bp.WithCS(func() error {
+		return c.bp.spiDuplexInto(w, r)
+	})
+}
+
+func (c *SpiConn) String() string {
+	return "buspirate spi"
+}
@@ -0,0 +1,84 @@
+package buspirate
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpiSetupAcks(t *testing.T) {
+	cfg := DefaultSpiConfig()
+	cfg.Mode = 3
+	cfg.Power = true
+	cfg.CSActiveLow = false
+	idle, edge := cfg.cfgBits()
+	speed := byte(spiSpeedCfg | SpiSpeed1mhz)
+	bus := spiCfg | cfgNibble(true, idle, edge, false)
+	periph := spiPeriphCfg | cfgNibble(true, false, false, false)
+	cs := spiCSState | cfgNibble(false, false, false, false)
+
+	for _, tc := range []struct {
+		name    string
+		once    map[byte][]byte
+		stored  int // settings acked, in command order
+		timeout bool
+	}{
+		{"all acked", nil, 4, false},
+		// corrupted and doubled, leaving a byte to flush
+		{"2nd corrupt", map[byte][]byte{bus: {0x00, 0x01}}, 1, false},
+		{"3rd corrupt", map[byte][]byte{periph: {0x00}}, 2, false},
+		// the device stops answering
+		{"2nd missing", map[byte][]byte{bus: nil, periph: nil, cs: nil}, 1, true},
+		{"3rd missing", map[byte][]byte{periph: nil, cs: nil}, 2, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePort()
+			bp := fakeSpi(t, f, WithModeTimeout(ModeSpi, 50*time.Millisecond))
+			f.once = tc.once
+			err := bp.SpiSetup(cfg)
+			if (err == nil) != (tc.stored == 4) {
+				t.Fatalf("SpiSetup: %v", err)
+			}
+			if got := errors.Is(err, ErrTimeout); got != tc.timeout {
+				t.Fatalf("SpiSetup: %v, timeout %v, want %v", err, got, tc.timeout)
+			}
+			want := []byte{speed, bus, periph, cs}
+			for i, got := range []byte{bp.spiSpeed, bp.spiCfg, bp.periph, bp.spiCS} {
+				if i < tc.stored && got != want[i] {
+					t.Errorf("setting %d is 0x%02x, want 0x%02x", i+1, got, want[i])
+				}
+				if i >= tc.stored && got == want[i] {
+					t.Errorf("setting %d stored without its ack", i+1)
+				}
+			}
+			if bp.spiCSActiveHigh != (tc.stored == 4) {
+				t.Errorf("chip select active high %v with %d acks", bp.spiCSActiveHigh, tc.stored)
+			}
+			if err := bp.Ping(); err != nil {
+				t.Fatalf("Ping after SpiSetup: %v", err)
+			}
+		})
+	}
+}
+
+func TestSpiConnTx(t *testing.T) {
+	f := newFakePort()
+	bp := fakeSpi(t, f)
+	// more than one 16 byte bulk transfer, on the loopback
+	w := make([]byte, 20)
+	for i := range w {
+		w[i] = byte(i + 1)
+	}
+	r := make([]byte, len(w))
+	if err := NewSpiConn(bp).Tx(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r, w) {
+		t.Fatalf("read % x, want % x", r, w)
+	}
+	if want := []bool{false, true}; !reflect.DeepEqual(f.csLog, want) {
+		t.Fatalf("chip select %v, want %v", f.csLog, want)
+	}
+}
@@ -0,0 +1,59 @@
+package buspirate
+
+import (
+	"fmt"
+)
+
+// SpiSetCSPin sets the pin SpiSelect and SpiDeselect drive as chip select,
+// and with them WithCS, SpiWriteRead and the helpers built on them, to let
+// one session talk to two SPI devices sharing MOSI, MISO and CLK. SPI mode
+// controls only two pins besides the bus: CS, the default, and AUX, which
+// is driven through the peripheral config, as SetAux does. Any other pin
+// fails with an error.
+//
+// With AUX as chip select, the write then read command can't frame the
+// transfer with it, so SpiWriteRead sends the no-CS command within an
+// explicit SpiSelect and SpiDeselect, costing two more round trips, and
+// the built-in CS is left deasserted throughout. AUX is deselected at
+// once, at the polarity set for CS. SpiSetup and SpiCfgPeriph set AUX as
+// they're told, so call SpiSetCSPin after them; SpiCS still drives the
+// built-in CS, whichever pin is selected. The pin is CS again once SPI
+// mode is left.
+func (bp *BusPirate) SpiSetCSPin(pin Pin) error {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return err
+	}
+	switch pin {
+	case PinCS:
+	case PinAUX:
+		if err := bp.SetAux(!bp.spiCSActiveHigh); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("error, %v can't be a chip select in spi mode, only CS and AUX are outputs there", pin)
+	}
+	bp.spiCSPin = pin
+	return nil
+}
+
+// SpiSelect asserts the chip select pin set with SpiSetCSPin, by default
+// the built-in CS.
+func (bp *BusPirate) SpiSelect() error {
+	return bp.spiSelectPin(bp.spiCSActiveHigh)
+}
+
+// SpiDeselect deasserts the chip select pin set with SpiSetCSPin, by
+// default the built-in CS.
+func (bp *BusPirate) SpiDeselect() error {
+	return bp.spiSelectPin(!bp.spiCSActiveHigh)
+}
+
+func (bp *BusPirate) spiSelectPin(high bool) error {
+	if bp.spiCSPin == PinAUX {
+		if err := bp.checkMode(ModeSpi); err != nil {
+			return err
+		}
+		return bp.SetAux(high)
+	}
+	return bp.SpiCS(high)
+}
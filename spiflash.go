@@ -0,0 +1,176 @@
+package buspirate
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const (
+	flashPageProgram = 0x02
+	flashRead        = 0x03
+	flashReadStatus  = 0x05
+	flashWriteEnable = 0x06
+	flashSectorErase = 0x20
+	flashChipErase   = 0xC7
+
+	flashStatusBusy = 0x01 // status register WIP, write in progress bit
+
+	flashPageSize   = 256
+	flashSectorSize = 4096
+
+	// worst case busy times, with a margin over common datasheet maximums
+	flashProgramWait   = 100 * time.Millisecond
+	flashSectorWait    = 2 * time.Second
+	flashChipEraseWait = 10 * time.Minute
+
+	// flashChunk is the number of bytes read per SPI write/read command.
+	flashChunk = 256
+
+	// flashDumpBlock is the number of bytes read per write to a Dump
+	// writer.
+	flashDumpBlock = 4096
+)
+
+// SpiFlash is a driver for 25-series SPI NOR flash chips attached to a Bus
+// Pirate in SPI mode. Its reads use write then read commands, which clock
+// out 0xFF while reading, as flash expects, whatever WithSpiFillByte sets.
+type SpiFlash struct {
+	bp *BusPirate
+}
+
+// NewSpiFlash returns a flash driver using bp, which must already be in SPI
+// mode with its speed and configuration set.
+func NewSpiFlash(bp *BusPirate) *SpiFlash {
+	return &SpiFlash{bp: bp}
+}
+
+// Read reads len(buf) bytes starting at addr.
+func (f *SpiFlash) Read(addr uint32, buf []byte) error {
+	return f.ReadContext(context.Background(), addr, buf, nil)
+}
+
+// ReadContext reads len(buf) bytes starting at addr in chunks of 256 bytes,
+// each chunk its own CS-framed read command. progress, if not nil, is called
+// after each chunk with the bytes read so far and the total. The read stops
+// between chunks, returning the context's error, if ctx is done.
+func (f *SpiFlash) ReadContext(ctx context.Context, addr uint32, buf []byte, progress func(done, total int)) error {
+	total := len(buf)
+	for done := 0; done < total; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l := total - done
+		if l > flashChunk {
+			l = flashChunk
+		}
+		a := addr + uint32(done)
+		cmd := []byte{flashRead, byte(a >> 16), byte(a >> 8), byte(a)}
+		if err := f.bp.SpiWriteRead(cmd, buf[done:done+l]); err != nil {
+			return err
+		}
+		done += l
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+	return nil
+}
+
+// Dump copies size bytes starting at addr to w, returning the number of
+// bytes written and their running CRC-32 (IEEE). It's meant for reading out
+// whole chips, which takes minutes at the lower SPI speeds.
+//
+// An interrupted dump can be resumed: pass as offset the bytes already
+// dumped, the earlier offset plus the earlier written count, and as crc the
+// checksum the interrupted Dump returned, and the checksum returned at the
+// end is that of the whole region. Start a fresh dump with offset and crc
+// 0. The dump stops between chunks, returning the context's error, if ctx
+// is done; the counts returned then cover exactly what reached w. progress,
+// if not nil, is called after each block written with the bytes dumped so
+// far, including offset, and size.
+func (f *SpiFlash) Dump(ctx context.Context, w io.Writer, addr uint32, size, offset int, crc uint32, progress func(done, total int)) (int, uint32, error) {
+	buf := make([]byte, flashDumpBlock)
+	written := 0
+	for done := offset; done < size; {
+		l := size - done
+		if l > len(buf) {
+			l = len(buf)
+		}
+		// a block reaches w only once it has been read in full
+		if err := f.ReadContext(ctx, addr+uint32(done), buf[:l], nil); err != nil {
+			return written, crc, err
+		}
+		n, err := w.Write(buf[:l])
+		crc = crc32.Update(crc, crc32.IEEETable, buf[:n])
+		written += n
+		done += n
+		if err != nil {
+			return written, crc, err
+		}
+		if progress != nil {
+			progress(done, size)
+		}
+	}
+	return written, crc, nil
+}
+
+// SectorErase erases the 4KB sector containing addr, leaving it all 0xFF,
+// and waits for the erase to finish.
+func (f *SpiFlash) SectorErase(addr uint32) error {
+	a := addr &^ (flashSectorSize - 1)
+	return f.write([]byte{flashSectorErase, byte(a >> 16), byte(a >> 8), byte(a)}, flashSectorWait)
+}
+
+// ChipErase erases the whole chip, leaving it all 0xFF, and waits for the
+// erase to finish. Large chips take minutes.
+func (f *SpiFlash) ChipErase() error {
+	return f.write([]byte{flashChipErase}, flashChipEraseWait)
+}
+
+// PageProgram writes data starting at addr, which must have been erased.
+// The chip programs at most one 256 byte page per command and wraps
+// within the page, so data is split at page boundaries, each part its own
+// program command, waiting for each to finish before the next.
+func (f *SpiFlash) PageProgram(addr uint32, data []byte) error {
+	for len(data) > 0 {
+		l := flashPageSize - int(addr%flashPageSize)
+		if l > len(data) {
+			l = len(data)
+		}
+		cmd := append([]byte{flashPageProgram, byte(addr >> 16), byte(addr >> 8), byte(addr)}, data[:l]...)
+		if err := f.write(cmd, flashProgramWait); err != nil {
+			return err
+		}
+		addr += uint32(l)
+		data = data[l:]
+	}
+	return nil
+}
+
+// write issues a write enable and then cmd, an erase or program command,
+// and polls the status register until the chip is no longer busy, for up
+// to timeout.
+func (f *SpiFlash) write(cmd []byte, timeout time.Duration) error {
+	if err := f.bp.SpiWriteRead([]byte{flashWriteEnable}, nil); err != nil {
+		return err
+	}
+	if err := f.bp.SpiWriteRead(cmd, nil); err != nil {
+		return err
+	}
+	status := make([]byte, 1)
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := f.bp.SpiWriteRead([]byte{flashReadStatus}, status); err != nil {
+			return err
+		}
+		if status[0]&flashStatusBusy == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("error waiting for flash command 0x%02x to finish, status: 0x%02x, %w", cmd[0], status[0], ErrTimeout)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package buspirate
+
+import (
+	"fmt"
+	"time"
+)
+
+// spiSlaveTimeout bounds the wait for the master to select the Bus Pirate
+// in SpiSlaveRespond, and then for it to clock the data.
+const spiSlaveTimeout = 10 * time.Second
+
+// SpiSlaveRespond plays an SPI slave to an external master, for testing
+// master code: once the master pulls CS low, data is shifted out on MISO,
+// MSB first, one bit per clock, and the bits the master sends on MOSI are
+// returned. There's no slave mode in the firmware, so this runs in bitbang
+// mode, with MISO the only output, polling the pins and setting MISO with
+// one pin command per poll. Only SPI mode 0 is handled: clock idle low,
+// MISO set while the clock is low and sampled by both sides on the rising
+// edge.
+//
+// Each poll is a USB round trip, so the master's clock has to be
+// extremely slow: every half period must span at least two polls, which
+// puts the limit around 250Hz on a v4 and 15Hz on a v3 at its FTDI
+// bridge's default latency timer, i.e. a master that bit-bangs its SPI.
+// Missed edges can't be seen, but a master that deselects before all of
+// data has been clocked out fails the exchange with the bit count reached,
+// as does a clock that's high when CS goes low, and ErrTimeout is returned
+// if CS isn't pulled low, or the data isn't clocked, within 10s. The pins
+// are all inputs again afterwards.
+func (bp *BusPirate) SpiSlaveRespond(data []byte) (in []byte, err error) {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	base := bbPinSet | bp.pinSet&(pinPower|pinPullup)
+	bit := func(i int) byte {
+		if data[i/8]&(0x80>>(i%8)) != 0 {
+			return base | pinMISO
+		}
+		return base
+	}
+
+	// the first bit is on MISO as soon as it's driven
+	if _, err := bp.pinCmd(bit(0)); err != nil {
+		return nil, err
+	}
+	if _, err := bp.pinCmd(bbPinDir | pinAUX | pinMOSI | pinCLK | pinCS); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if _, rerr := bp.pinCmd(bbPinDir | pinAUX | pinMOSI | pinCLK | pinMISO | pinCS); err == nil {
+			err = rerr
+		}
+	}()
+
+	deadline := time.Now().Add(spiSlaveTimeout)
+	for {
+		state, err := bp.pinCmd(bit(0))
+		if err != nil {
+			return nil, err
+		}
+		if state&pinCS == 0 {
+			if state&pinCLK != 0 {
+				return nil, fmt.Errorf("error, spi clock high when cs asserted, only spi mode 0 is supported")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("error, spi master didn't assert cs within %v, %w", spiSlaveTimeout, ErrTimeout)
+		}
+	}
+
+	in = make([]byte, len(data))
+	bits := len(data) * 8
+	deadline = time.Now().Add(spiSlaveTimeout)
+	clkHigh := false
+	for i := 0; i < bits; {
+		state, err := bp.pinCmd(bit(i))
+		if err != nil {
+			return in, err
+		}
+		if state&pinCS != 0 {
+			return in, fmt.Errorf("error, spi master deselected after %d of %d bits, its clock may be too fast to poll", i, bits)
+		}
+		high := state&pinCLK != 0
+		switch {
+		case high && !clkHigh:
+			// rising edge: MOSI is valid while the clock is high
+			if state&pinMOSI != 0 {
+				in[i/8] |= 0x80 >> (i % 8)
+			}
+		case !high && clkHigh:
+			// falling edge: on to the next bit
+			i++
+		}
+		clkHigh = high
+		if time.Now().After(deadline) {
+			return in, fmt.Errorf("error, spi master clocked %d of %d bits in %v, %w", i, bits, spiSlaveTimeout, ErrTimeout)
+		}
+	}
+	return in, nil
+}
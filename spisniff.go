@@ -0,0 +1,104 @@
+package buspirate
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	spiSniffAllCmd   = 0x0D
+	spiSniffCSLowCmd = 0x0E
+)
+
+// SpiSniffMode selects the traffic the SPI sniffer captures.
+type SpiSniffMode uint8
+
+// SpiSniffMode values. The zero value, SpiSniffCSLow, is usually what's
+// wanted on a shared bus.
+const (
+	// SpiSniffCSLow captures data only while CS is low, i.e. the traffic
+	// of the one device selected by the CS line the Bus Pirate watches.
+	SpiSniffCSLow SpiSniffMode = iota
+
+	// SpiSniffAll captures all data clocked on the bus, whatever the
+	// state of CS, e.g. for devices with their own chip selects.
+	SpiSniffAll
+)
+
+// SpiSniffed is a chip select edge or a data byte seen by the sniffer.
+type SpiSniffed struct {
+	// CSEdge is set for a chip select edge, with CSLow telling which; the
+	// data fields are then unused.
+	CSEdge bool
+	CSLow  bool
+
+	// MOSI and MISO are the bytes exchanged in one byte time.
+	MOSI byte
+	MISO byte
+}
+
+// SpiSniff starts the SPI sniffer, in SPI mode, and sends what it sees on
+// the returned channel until ctx is done. The Bus Pirate is a passive
+// listener on the bus, with its CLK, MOSI, MISO and CS pins as inputs,
+// using the clock polarity and edge last set with SpiCfg. Events the
+// receiver doesn't keep up with are dropped, and the sniffer itself loses
+// data when the bus outpaces the serial link, past roughly 10kB/s of
+// traffic. The channel is closed once the sniffer has stopped, or on an
+// I/O error; until then other commands fail with ErrStreamActive.
+func (bp *BusPirate) SpiSniff(ctx context.Context, mode SpiSniffMode) (<-chan SpiSniffed, error) {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return nil, err
+	}
+	cmd := byte(spiSniffCSLowCmd)
+	what := "spi sniff cs low"
+	if mode == SpiSniffAll {
+		cmd, what = spiSniffAllCmd, "spi sniff all"
+	}
+	if err := bp.writeCmd(cmd, what); err != nil {
+		return nil, err
+	}
+
+	bp.streaming.Store(true)
+	ch := make(chan SpiSniffed)
+	go func() {
+		defer func() {
+			// any byte stops the sniffer, which consumes it
+			bp.write([]byte{0xFF}, writeTimeout)
+			bp.drain()
+			bp.flushInput()
+			bp.streaming.Store(false)
+			close(ch)
+		}()
+		buf := make([]byte, 2)
+		for ctx.Err() == nil {
+			n, err := bp.read(buf[:1], 100*time.Millisecond)
+			if err != nil {
+				return
+			}
+			if n == 0 {
+				continue
+			}
+			var ev SpiSniffed
+			switch buf[0] {
+			case '[':
+				ev = SpiSniffed{CSEdge: true, CSLow: true}
+			case ']':
+				ev = SpiSniffed{CSEdge: true}
+			case '\\':
+				// escaped data: the MOSI byte then the MISO byte
+				if _, err := bp.readFull(buf, bp.cmdTimeout()); err != nil {
+					return
+				}
+				ev = SpiSniffed{MOSI: buf[0], MISO: buf[1]}
+			default:
+				continue
+			}
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
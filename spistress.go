@@ -0,0 +1,78 @@
+package buspirate
+
+import (
+	"math/bits"
+	"math/rand"
+	"time"
+)
+
+// SpiStressResult summarizes a SpiLoopbackStress run.
+type SpiStressResult struct {
+	Transfers  int // bulk transfers of 1-16 bytes
+	Bytes      int
+	Mismatches int // transfers that read back at least one wrong bit
+	BitErrors  int
+
+	// BitPositions counts the bit errors by bit position, 0 the LSB.
+	// Errors clustered on the first or last bit clocked point at sampling
+	// too early or late, which SpiConfig.SampleEnd or a lower speed fixes;
+	// errors spread evenly point at noise.
+	BitPositions [8]int
+}
+
+// BitErrorRate returns the fraction of the bits transferred that read back
+// wrong.
+func (r SpiStressResult) BitErrorRate() float64 {
+	if r.Bytes == 0 {
+		return 0
+	}
+	return float64(r.BitErrors) / float64(r.Bytes*8)
+}
+
+// SpiLoopbackStress runs iterations bulk transfers of random data and
+// length at speed, with MOSI jumpered to MISO as for SpiLoopbackTest, and
+// counts the bits that don't read back as sent. It's meant for qualifying
+// the wiring to a target before trusting it at high speeds, e.g. 8MHz over
+// long jumper wires. The SPI speed in use before the run is restored
+// afterwards. An I/O error stops the run, returning the result so far.
+func (bp *BusPirate) SpiLoopbackStress(iterations int, speed SpiSpeed) (SpiStressResult, error) {
+	var res SpiStressResult
+	prev := SpiSpeed(bp.spiSpeed & 0x07)
+	if err := bp.SpiSpeed(speed); err != nil {
+		return res, err
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	out := make([]byte, 16)
+	in := make([]byte, 16)
+	var err error
+	for i := 0; i < iterations; i++ {
+		data := out[:1+rnd.Intn(len(out))]
+		rnd.Read(data)
+		if err = bp.SpiSendInto(data, in); err != nil {
+			break
+		}
+		res.Transfers++
+		res.Bytes += len(data)
+		mismatch := false
+		for j := range data {
+			diff := data[j] ^ in[j]
+			if diff == 0 {
+				continue
+			}
+			mismatch = true
+			res.BitErrors += bits.OnesCount8(diff)
+			for b := 0; b < 8; b++ {
+				if diff&(1<<b) != 0 {
+					res.BitPositions[b]++
+				}
+			}
+		}
+		if mismatch {
+			res.Mismatches++
+		}
+	}
+	if serr := bp.SpiSpeed(prev); err == nil {
+		err = serr
+	}
+	return res, err
+}
@@ -0,0 +1,226 @@
+package buspirate
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// textCommand issues cmd at the text-mode prompt and returns its output,
+// without the echoed command line or the closing prompt.
+func (bp *BusPirate) textCommand(cmd string) (string, error) {
+	return bp.textCommandTimeout(cmd, 2*time.Second)
+}
+
+// textCommandTimeout is textCommand waiting up to timeout for the prompt.
+func (bp *BusPirate) textCommandTimeout(cmd string, timeout time.Duration) (string, error) {
+	bp.discardInput()
+	if n, err := bp.write([]byte(cmd+"\n"), writeTimeout); n == 0 || err != nil {
+		return "", bp.cmdError("error writing text command %q, n: %d, %w", cmd, n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return "", err
+	}
+	out, err := bp.readPrompt(timeout)
+	if err != nil {
+		return "", bp.cmdError("error reading text command %q reply, %w", cmd, err)
+	}
+	// drop the echoed command line and the prompt line
+	if i := strings.Index(out, "\n"); i >= 0 {
+		out = out[i+1:]
+	}
+	if i := strings.LastIndex(out, "\n"); i >= 0 {
+		out = out[:i+1]
+	} else {
+		out = ""
+	}
+	return out, nil
+}
+
+// readPrompt reads text-mode output until it ends in a prompt, e.g. "HiZ>".
+func (bp *BusPirate) readPrompt(timeout time.Duration) (string, error) {
+	var out []byte
+	buf := make([]byte, 256)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n, err := bp.read(buf, 100*time.Millisecond)
+		if err != nil {
+			return string(out), err
+		}
+		out = append(out, buf[:n]...)
+		if n == 0 && bytes.HasSuffix(bytes.TrimRight(out, " "), []byte(">")) {
+			return string(out), nil
+		}
+	}
+	return string(out), ErrTimeout
+}
+
+// readUntil reads text-mode output until it contains s.
+func (bp *BusPirate) readUntil(s string, timeout time.Duration) (string, error) {
+	var out []byte
+	buf := make([]byte, 256)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n, err := bp.read(buf, 100*time.Millisecond)
+		if err != nil {
+			return string(out), err
+		}
+		out = append(out, buf[:n]...)
+		if bytes.Contains(out, []byte(s)) {
+			return string(out), nil
+		}
+	}
+	return string(out), ErrTimeout
+}
+
+// withTextMode drops the device to text mode, runs fn and re-enters binary
+// mode. Any protocol mode is left; the session continues in bitbang mode.
+// A device already in text mode, e.g. opened WithoutBinaryMode, just runs
+// fn and stays there.
+func (bp *BusPirate) withTextMode(fn func() error) error {
+	if bp.mode == ModeText && !bp.streaming.Load() {
+		return fn()
+	}
+	if err := bp.checkMode(binaryModes...); err != nil {
+		return err
+	}
+	if err := recoverTextMode(bp.port); err != nil {
+		return err
+	}
+	bp.mode = ModeText
+	bp.clearModeState()
+	err := fn()
+	if binErr := bp.enterBinaryMode(); err == nil {
+		err = binErr
+	}
+	return err
+}
+
+// macroTimeout bounds a macro run; the I2C address search takes a few
+// seconds at the slowest speed.
+const macroTimeout = 10 * time.Second
+
+// RunMacro runs the firmware's macro n, as typed "(n)" at the prompt, and
+// returns its output once the prompt is back, e.g. macro 1 in I2C mode,
+// the 7 bit address search. Macro 0 lists the macros of the mode. Macros
+// belong to the text-mode protocol modes, so RunMacro needs a session in
+// text mode, opened WithoutBinaryMode, with the mode already set up at its
+// prompt, e.g. by writing the 'm' menu answers through the embedded Term;
+// in binary mode it fails with ErrWrongMode, and at the HiZ prompt the
+// firmware answers with an error message, which is returned as output.
+func (bp *BusPirate) RunMacro(n int) (string, error) {
+	if err := bp.checkMode(ModeText); err != nil {
+		return "", err
+	}
+	if n < 0 {
+		return "", fmt.Errorf("error, invalid macro number: %d", n)
+	}
+	return bp.textCommandTimeout(fmt.Sprintf("(%d)", n), macroTimeout)
+}
+
+// DeviceInfo returns the device's text-mode 'i' info banner: the hardware,
+// firmware and bootloader versions and the PIC device and revision IDs.
+// It's what's asked for in bug reports; ParseVersion picks it apart.
+// The device is reset to text mode to issue the command, so any protocol
+// mode is left; the session continues in bitbang mode.
+func (bp *BusPirate) DeviceInfo() (string, error) {
+	var info string
+	err := bp.withTextMode(func() error {
+		var err error
+		info, err = bp.textCommand("i")
+		if err == nil {
+			bp.info = info
+		}
+		return err
+	})
+	return info, err
+}
+
+// LastDeviceError collects what the device has to say after a binary
+// command fails. Reply bytes still unread in the input buffer, which often
+// show where the session desynced, are always returned. With textMode, the
+// device is also reset to text mode for its 'v' pin state and voltage
+// report, which shows e.g. a rail pulled down by a short, and then
+// re-enters binary mode; this leaves any protocol mode and the session
+// continues in bitbang mode. While a stream is running the input belongs
+// to it, and LastDeviceError fails with ErrStreamActive.
+func (bp *BusPirate) LastDeviceError(textMode bool) (string, error) {
+	if bp.streaming.Load() {
+		return "", ErrStreamActive
+	}
+	var pending []byte
+	buf := make([]byte, 64)
+	for i := 0; i < 100; i++ {
+		n, err := bp.read(buf, 20*time.Millisecond)
+		if n == 0 || err != nil {
+			break
+		}
+		pending = append(pending, buf[:n]...)
+	}
+	report := fmt.Sprintf("unread: % x\n", pending)
+	if !textMode {
+		return report, nil
+	}
+	err := bp.withTextMode(func() error {
+		v, err := bp.textCommand("v")
+		report += v
+		return err
+	})
+	return report, err
+}
+
+// PullupVoltage measures the voltage on the Vpu pin, the supply the pullup
+// resistors pull up to: the board's own 3.3V or 5V if it's jumpered to
+// one, or whatever the target provides. Enabling the pullups does nothing
+// without it, which is the most common reason an I2C bus sees no ACKs.
+// The binary protocol only measures the ADC probe, so the device is reset
+// to text mode for its 'v' report, which leaves any protocol mode; the
+// session continues in bitbang mode.
+//
+// The bus is only reliable with Vpu close to the supply of the devices on
+// it: a logic high is anything above 0.7 of the supply, 2.3V for 3.3V
+// parts and 3.5V for 5V parts. Near 0V, Vpu is floating.
+func (bp *BusPirate) PullupVoltage() (float64, error) {
+	var report string
+	err := bp.withTextMode(func() error {
+		var err error
+		report, err = bp.textCommand("v")
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return parseVpu(report)
+}
+
+// parseVpu finds the Vpu voltage in a 'v' report, whose pin names line is
+// followed, some lines later, by a line of voltages and levels in the same
+// columns:
+//
+//	GND	3.3V	5.0V	ADC	VPU	AUX	CLK	MOSI	CS	MISO
+//	P	P	P	I	I	I	I	I	I	I
+//	GND	3.29V	4.98V	0.00V	3.30V	L	L	L	H	L
+func parseVpu(report string) (float64, error) {
+	col := -1
+	var names []string
+	for _, line := range strings.Split(report, "\n") {
+		f := strings.Fields(line)
+		if col < 0 {
+			for i, name := range f {
+				if name == "VPU" {
+					col, names = i, f
+				}
+			}
+			continue
+		}
+		if len(f) != len(names) || !strings.HasSuffix(f[col], "V") {
+			continue
+		}
+		var v float64
+		if _, err := fmt.Sscanf(f[col], "%fV", &v); err == nil {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("error, no vpu voltage in the 'v' report: %q", report)
+}
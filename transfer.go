@@ -0,0 +1,70 @@
+package buspirate
+
+import (
+	"fmt"
+	"time"
+)
+
+// Transfer writes write and then reads readLen bytes with the transfer
+// command of the current mode, for code that works across protocols:
+//
+//   - SPI: a write then read command, SpiWriteRead, which asserts chip
+//     select for the transfer; the bytes read are those clocked in after
+//     the write.
+//   - I2C: write[0] is the 7 bit address and the rest the data, sent with
+//     I2cWriteRead in one transaction; with no data the read is a plain
+//     read from the address. write must hold at least the address.
+//   - UART: write is sent with UartWrite, and RX echo is then turned on
+//     until readLen bytes arrive, within the mode's reply timeout, or the
+//     read fails with ErrTimeout. RX data received before the write
+//     finished is lost, so a reply only works from devices that take
+//     longer to answer than a USB round trip.
+//
+// In any other mode, bitbang and raw-wire included, Transfer returns
+// ErrWrongMode.
+func (bp *BusPirate) Transfer(write []byte, readLen int) ([]byte, error) {
+	if err := bp.checkMode(ModeSpi, ModeI2c, ModeUart); err != nil {
+		return nil, err
+	}
+	if readLen < 0 {
+		return nil, fmt.Errorf("error, invalid transfer read length: %d", readLen)
+	}
+	switch bp.mode {
+	case ModeSpi:
+		in := make([]byte, readLen)
+		if err := bp.SpiWriteRead(write, in); err != nil {
+			return nil, err
+		}
+		return in, nil
+	case ModeI2c:
+		if len(write) == 0 {
+			return nil, fmt.Errorf("error, i2c transfer needs the address as the first byte")
+		}
+		return bp.I2cWriteRead(write[0], write[1:], readLen)
+	}
+
+	if err := bp.UartWrite(write); err != nil {
+		return nil, err
+	}
+	if readLen == 0 {
+		return nil, nil
+	}
+	return bp.uartReadN(readLen, bp.cmdTimeout())
+}
+
+// uartReadN turns RX echo on, reads n bytes within timeout, and turns echo
+// off again.
+func (bp *BusPirate) uartReadN(n int, timeout time.Duration) ([]byte, error) {
+	if err := bp.UartSetEcho(true); err != nil {
+		return nil, err
+	}
+	in := make([]byte, n)
+	got, err := bp.readFull(in, timeout)
+	if eerr := bp.UartSetEcho(false); err == nil {
+		err = eerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading uart transfer reply, %d of %d bytes, %w", got, n, err)
+	}
+	return in, nil
+}
@@ -0,0 +1,339 @@
+package buspirate
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	uartMode          = 0x03
+	uartEchoStart     = 0x02
+	uartEchoStop      = 0x03
+	uartBulkWriteMode = 0x10
+	uartPeriphCfg     = 0x40
+	uartSpeedCfg      = 0x60
+	uartCfg           = 0x80
+)
+
+// UartEnter enters binary UART mode. RX echo is off on entry.
+func (bp *BusPirate) UartEnter() error {
+	if err := bp.checkMode(ModeBitbang); err != nil {
+		return err
+	}
+	if n, err := bp.write([]byte{uartMode}, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing enter uart mode, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if n, err := bp.readFull(reply, bp.cmdTimeout()); err != nil || string(reply) != "ART1" {
+		err = bp.cmdError("error reading enter uart mode, n: %d, %w", n, replyErr(n, err))
+		bp.flushInput()
+		return err
+	}
+	bp.mode = ModeUart
+	return nil
+}
+
+// UartLeave exits UART mode, returning to bitbang mode. RX echo must be off.
+func (bp *BusPirate) UartLeave() error {
+	return bp.BitbangEnter()
+}
+
+// UartCfgPeriph configures the uart peripherals.
+// 0100wxyz – Configure peripherals w=power, x=pullups, y=AUX, z=CS
+func (bp *BusPirate) UartCfgPeriph(power, pullups, aux, cs bool) error {
+	if err := bp.checkMode(ModeUart); err != nil {
+		return err
+	}
+	buf := []byte{uartPeriphCfg}
+	if power {
+		buf[0] |= 0x08
+	}
+	if pullups {
+		buf[0] |= 0x04
+	}
+	if aux {
+		buf[0] |= 0x02
+	}
+	if cs {
+		buf[0] |= 0x01
+	}
+	if err := bp.writeCfg(buf[0], "uart periph cfg"); err != nil {
+		return err
+	}
+	bp.periph = buf[0]
+	return nil
+}
+
+// UartSpeed is the UART baud rate
+type UartSpeed uint8
+
+// UartSpeed is the UART baud rate
+const (
+	UartSpeed300    UartSpeed = 0x00
+	UartSpeed1200   UartSpeed = 0x01
+	UartSpeed2400   UartSpeed = 0x02
+	UartSpeed4800   UartSpeed = 0x03
+	UartSpeed9600   UartSpeed = 0x04
+	UartSpeed19200  UartSpeed = 0x05
+	UartSpeed31250  UartSpeed = 0x06
+	UartSpeed38400  UartSpeed = 0x07
+	UartSpeed57600  UartSpeed = 0x08
+	UartSpeed115200 UartSpeed = 0x0A
+)
+
+// UartSpeed sets the UART baud rate.
+func (bp *BusPirate) UartSpeed(speed UartSpeed) error {
+	if err := bp.checkMode(ModeUart); err != nil {
+		return err
+	}
+	cmd := uartSpeedCfg | byte(speed&0x0F)
+	if err := bp.writeCfg(cmd, "uart speed"); err != nil {
+		return err
+	}
+	bp.uartSpeed = cmd
+	return nil
+}
+
+// UartDataBits sets the number of data bits, 8 or 9, through the UART
+// configuration command, 100wxxyz, keeping the output type, stop bits and
+// polarity last set. The data bits and parity share the xx field, and 9
+// bits is only available without parity, so 9 clears any parity set and
+// going back to 8 bits leaves parity off.
+//
+// The binary protocol carries bytes, so in 9 bit mode the data written is
+// sent with the 9th bit 0 and the 9th bit of received data is dropped;
+// multi-drop protocols that mark addresses with the 9th bit can be
+// listened to but not driven.
+func (bp *BusPirate) UartDataBits(n int) error {
+	if err := bp.checkMode(ModeUart); err != nil {
+		return err
+	}
+	cmd := bp.uartCfg
+	if cmd == 0 {
+		cmd = uartCfg
+	}
+	switch n {
+	case 8:
+		if cmd&0x0C == 0x0C {
+			cmd &^= 0x0C
+		}
+	case 9:
+		cmd |= 0x0C
+	default:
+		return fmt.Errorf("error, invalid uart data bits: %d, must be 8 or 9", n)
+	}
+	if err := bp.writeCfg(cmd, "uart cfg"); err != nil {
+		return err
+	}
+	bp.uartCfg = cmd
+	return nil
+}
+
+// UartSetEcho starts or stops echoing the bytes received on RX to the host.
+// Echo is what makes received data visible: with it off, RX data is
+// dropped by the device. With it on, received bytes arrive interleaved
+// with the replies to any other command, so turn it off before configuring
+// or writing; monitor-style reads should only be done with echo on.
+func (bp *BusPirate) UartSetEcho(on bool) error {
+	if err := bp.checkMode(ModeUart); err != nil {
+		return err
+	}
+	if on {
+		return bp.writeCmd(uartEchoStart, "uart echo start")
+	}
+
+	buf := []byte{uartEchoStop}
+	if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing uart echo stop, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return err
+	}
+	// RX data still in flight precedes the 0x01 reply; the reply is the
+	// last byte received once the device goes quiet
+	got := 0
+	for i := 0; i < 1000; i++ {
+		n, err := bp.read(buf, 100*time.Millisecond)
+		if err != nil {
+			return bp.cmdError("error reading uart echo stop reply, n: %d, %w", n, err)
+		}
+		if n == 0 {
+			break
+		}
+		got += n
+	}
+	if got == 0 || buf[0] != 0x01 {
+		return bp.cmdError("error reading uart echo stop reply, n: %d", got)
+	}
+	return nil
+}
+
+// UartWrite transmits data on TX, 16 bytes per bulk write command. RX echo
+// must be off.
+func (bp *BusPirate) UartWrite(data []byte) error {
+	if err := bp.checkMode(ModeUart); err != nil {
+		return err
+	}
+	for off := 0; off < len(data); off += 16 {
+		chunk := data[off:]
+		if len(chunk) > 16 {
+			chunk = chunk[:16]
+		}
+		l := len(chunk)
+		buf := []byte{uartBulkWriteMode | byte(l-1)}
+		if n, err := bp.write(buf, writeTimeout); n == 0 || err != nil {
+			return bp.cmdError("error writing uart bulk write, n: %d, %w", n, timeoutErr(n, err))
+		}
+		if err := bp.drain(); err != nil {
+			return err
+		}
+		if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 0x01 {
+			return bp.cmdError("error reading uart bulk write reply, n: %d, %w", n, replyErr(n, err))
+		}
+		// each byte is answered with 0x01
+		for i := 0; i < l; i++ {
+			if n, err := bp.write(chunk[i:i+1], writeTimeout); n == 0 || err != nil {
+				return bp.cmdError("error writing uart bulk write data, n: %d, %w", n, timeoutErr(n, err))
+			}
+			if err := bp.drain(); err != nil {
+				return err
+			}
+			if n, err := bp.read(buf, bp.cmdTimeout()); n == 0 || err != nil || buf[0] != 0x01 {
+				return bp.cmdError("error reading uart bulk write data reply, n: %d, %w", n, replyErr(n, err))
+			}
+		}
+	}
+	return nil
+}
+
+// UartSendBreak holds TX low for duration, a break condition as LIN and
+// some bootloaders use. The binary UART protocol has no break command, so
+// the device is dropped to bitbang mode, TX (MOSI) is driven low and then
+// high again, and UART mode is re-entered with the last applied peripheral
+// config and speed. The break lasts at least duration, plus the USB round
+// trip of the pin command that ends it, typically a millisecond or two.
+// RX echo must be off.
+func (bp *BusPirate) UartSendBreak(duration time.Duration) error {
+	if err := bp.checkMode(ModeUart); err != nil {
+		return err
+	}
+	if err := bp.bitbangReset(); err != nil {
+		return err
+	}
+	set := byte(bbPinSet)
+	if bp.periph&0x08 != 0 {
+		set |= pinPower
+	}
+	if bp.periph&0x04 != 0 {
+		set |= pinPullup
+	}
+	if _, err := bp.pinCmd(bbPinDir | pinAUX | pinCLK | pinMISO | pinCS); err != nil {
+		return err
+	}
+	if _, err := bp.pinCmd(set); err != nil {
+		return err
+	}
+	time.Sleep(duration)
+	if _, err := bp.pinCmd(set | pinMOSI); err != nil {
+		return err
+	}
+	if err := bp.UartEnter(); err != nil {
+		return err
+	}
+	return bp.uartRestore()
+}
+
+// UartReader reads the data received on RX, for monitoring a console or
+// log output. RX echo must be on, see UartSetEcho, and nothing else may be
+// sent to the device while reading.
+type UartReader struct {
+	bp       *BusPirate
+	deadline atomic.Int64 // UnixNano, 0 for none
+}
+
+// UartReader returns a reader of the data received on RX.
+func (bp *BusPirate) UartReader() *UartReader {
+	return &UartReader{bp: bp}
+}
+
+// SetReadDeadline sets the time after which Read gives up waiting for data,
+// as for a net.Conn: a Read blocked when the deadline passes, and any Read
+// after it, fails with an error that matches both ErrTimeout and
+// os.ErrDeadlineExceeded, and has a Timeout method returning true. The
+// deadline is absolute and applies to all future Reads until it's changed;
+// it can be extended, from another goroutine too, by setting a new one. The
+// zero time means Read waits for data indefinitely. A deadline set while a
+// Read is waiting takes effect within 100ms.
+func (r *UartReader) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		r.deadline.Store(0)
+	} else {
+		r.deadline.Store(t.UnixNano())
+	}
+	return nil
+}
+
+// Read reads up to len(p) bytes received on RX. It returns once a byte has
+// arrived, with whatever else arrives within a millisecond of it.
+func (r *UartReader) Read(p []byte) (int, error) {
+	if err := r.bp.checkMode(ModeUart); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		// wait in short steps so a new deadline is seen
+		wait := 100 * time.Millisecond
+		if d := r.deadline.Load(); d != 0 {
+			left := time.Until(time.Unix(0, d))
+			if left <= 0 {
+				return 0, uartDeadlineError{}
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+		n, err := r.bp.read(p[:1], wait)
+		if err != nil {
+			return n, err
+		}
+		if n == 0 {
+			continue
+		}
+		if len(p) == 1 {
+			return 1, nil
+		}
+		m, err := r.bp.read(p[1:], time.Millisecond)
+		return 1 + m, err
+	}
+}
+
+// uartDeadlineError is returned by UartReader.Read past its deadline.
+type uartDeadlineError struct{}
+
+func (uartDeadlineError) Error() string { return "error, uart read deadline exceeded" }
+func (uartDeadlineError) Timeout() bool { return true }
+
+func (uartDeadlineError) Is(target error) bool {
+	return target == ErrTimeout || target == os.ErrDeadlineExceeded
+}
+
+// uartRestore re-issues the stored UART settings after UART mode is
+// re-entered.
+func (bp *BusPirate) uartRestore() error {
+	for _, cmd := range []byte{bp.periph, bp.uartSpeed, bp.uartCfg} {
+		if cmd == 0 {
+			continue
+		}
+		if err := bp.writeCfg(cmd, fmt.Sprintf("uart restore 0x%02x", cmd)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
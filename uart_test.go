@@ -0,0 +1,28 @@
+package buspirate
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestUartReaderReturnsEarly(t *testing.T) {
+	f := newFakePort()
+	bp := fakeBitbang(t, f)
+	// the reader only reads, so the fake needn't speak UART
+	bp.mode = ModeUart
+	f.delay = 10 * time.Millisecond
+	f.send([]byte("ok\r\n"))
+	p := make([]byte, 64)
+	start := time.Now()
+	n, err := bp.UartReader().Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("Read took %v with the data in after 10ms", d)
+	}
+	if !bytes.Equal(p[:n], []byte("ok\r\n")) {
+		t.Fatalf("read %q, want %q", p[:n], "ok\r\n")
+	}
+}
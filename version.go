@@ -0,0 +1,83 @@
+package buspirate
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Version is the device identification parsed from the 'i' info banner.
+// Fields the firmware doesn't report are left empty.
+type Version struct {
+	Hardware   string // e.g. "Bus Pirate v3.b"
+	Firmware   string // e.g. "v5.10 (r559)" or "v6.1 r1676"
+	Bootloader string // e.g. "v4.4"
+
+	// DevID and RevID are the PIC device and silicon revision IDs, e.g.
+	// "0x0447" and "0x3046". PIC is the part and revision they decode to,
+	// e.g. "24FJ64GA002 B8"; older firmware reports only the revision, "B5".
+	DevID string
+	RevID string
+	PIC   string
+}
+
+var (
+	versionFirmware   = regexp.MustCompile(`Firmware (v[0-9][^\s\[]*(?: \(r[0-9]+\)| r[0-9]+)?)`)
+	versionBootloader = regexp.MustCompile(`Bootloader (v[0-9][^\s]*)`)
+	versionDevID      = regexp.MustCompile(`DEVID:\s*(0x[0-9A-Fa-f]+)`)
+	versionRevID      = regexp.MustCompile(`REVID:\s*(0x[0-9A-Fa-f]+)(?:\s*\(([^)]*)\))?`)
+)
+
+// ParseVersion parses an info banner as returned by DeviceInfo. The banner
+// differs between boards and firmware, e.g. v3 firmware
+//
+//	Bus Pirate v3.b
+//	Firmware v5.10 (r559)  Bootloader v4.4
+//	DEVID:0x0447 REVID:0x3046 (24FJ64GA002 B8)
+//
+// and v4 community firmware
+//
+//	Bus Pirate v4
+//	Community Firmware v7.0 - goo.gl/gCzQnW [HiZ 1-WIRE UART I2C SPI 2WIRE 3WIRE KEYB LCD PIC DIO] Bootloader v4.5
+//	DEVID:0x1019 REVID:0x0004 (24FJ256GB106 A5)
+//
+// so each field is matched on its own wherever it appears.
+func ParseVersion(info string) Version {
+	var v Version
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Bus Pirate") {
+			v.Hardware = line
+			break
+		}
+	}
+	if m := versionFirmware.FindStringSubmatch(info); m != nil {
+		v.Firmware = m[1]
+	}
+	if m := versionBootloader.FindStringSubmatch(info); m != nil {
+		v.Bootloader = m[1]
+	}
+	if m := versionDevID.FindStringSubmatch(info); m != nil {
+		v.DevID = m[1]
+	}
+	if m := versionRevID.FindStringSubmatch(info); m != nil {
+		v.RevID = m[1]
+		v.PIC = strings.TrimSpace(m[2])
+	}
+	return v
+}
+
+// Version returns the device identification from the info banner read at
+// Open. The banner read there can be cut short on a slow link; if it has no
+// PIC revision the full banner is fetched with DeviceInfo, which leaves any
+// protocol mode.
+func (bp *BusPirate) Version() (Version, error) {
+	v := ParseVersion(bp.info)
+	if v.RevID != "" {
+		return v, nil
+	}
+	info, err := bp.DeviceInfo()
+	if err != nil {
+		return v, err
+	}
+	return ParseVersion(info), nil
+}
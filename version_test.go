@@ -0,0 +1,34 @@
+package buspirate
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		info string
+		want Version
+	}{
+		{"v3 firmware", "Bus Pirate v2go\r\nFirmware v3.0\r\nDEVID:0x0447 REVID:0x3042 (B4)\r\nhttp://www.buspirate.com\r\nHiZ>",
+			Version{Hardware: "Bus Pirate v2go", Firmware: "v3.0", DevID: "0x0447", RevID: "0x3042", PIC: "B4"}},
+		{"v4 firmware", "Bus Pirate v3a\r\nFirmware v4.2 Bootloader v4.1\r\nDEVID:0x0447 REVID:0x3043 (B5)\r\nhttp://dangerousprototypes.com\r\nHiZ>",
+			Version{Hardware: "Bus Pirate v3a", Firmware: "v4.2", Bootloader: "v4.1", DevID: "0x0447", RevID: "0x3043", PIC: "B5"}},
+		{"v5 firmware", fakeBanner,
+			Version{Hardware: "Bus Pirate v3.b", Firmware: "v5.10 (r559)", Bootloader: "v6.1", DevID: "0x0447", RevID: "0x3046", PIC: "24FJ64GA002 B8"}},
+		{"v6 firmware", "i\r\nBus Pirate v4\r\nFirmware v6.1 r1676  Bootloader v4.4\r\nDEVID:0x1019 REVID:0x0004 (24FJ256GB106 A5)\r\nhttp://dangerousprototypes.com\r\nHiZ>",
+			Version{Hardware: "Bus Pirate v4", Firmware: "v6.1 r1676", Bootloader: "v4.4", DevID: "0x1019", RevID: "0x0004", PIC: "24FJ256GB106 A5"}},
+		{"community firmware", "Bus Pirate v4\r\nCommunity Firmware v7.0 - goo.gl/gCzQnW [HiZ 1-WIRE UART I2C SPI 2WIRE 3WIRE KEYB LCD PIC DIO] Bootloader v4.5\r\nDEVID:0x1019 REVID:0x0004 (24FJ256GB106 A5)\r\nhttp://dangerousprototypes.com\r\nHiZ>",
+			Version{Hardware: "Bus Pirate v4", Firmware: "v7.0", Bootloader: "v4.5", DevID: "0x1019", RevID: "0x0004", PIC: "24FJ256GB106 A5"}},
+		{"cut short", "Bus Pirate v3.b\r\nFirmware v5.10 (r559)  Bootl",
+			Version{Hardware: "Bus Pirate v3.b", Firmware: "v5.10 (r559)"}},
+		{"no revision", "Bus Pirate v3.b\r\nFirmware v5.10 (r559)  Bootloader v4.4\r\nDEVID:0x0447 REVID:0x3046\r\n",
+			Version{Hardware: "Bus Pirate v3.b", Firmware: "v5.10 (r559)", Bootloader: "v4.4", DevID: "0x0447", RevID: "0x3046"}},
+		{"garbage", "\x00\xffBBIO1\r\nSyntax error at char 1\r\nHiZ>", Version{}},
+		{"empty", "", Version{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ParseVersion(tc.info); got != tc.want {
+				t.Fatalf("ParseVersion = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package buspirate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// modeVersionCmd asks a protocol mode for its version string, e.g. "SPI1".
+const modeVersionCmd = 0x01
+
+// modeVersions are the version strings of the protocol modes, less the
+// version digit.
+var modeVersions = map[Mode]string{
+	ModeSpi:     "SPI",
+	ModeI2c:     "I2C",
+	ModeUart:    "ART",
+	ModeRawWire: "RAW",
+}
+
+// Ping checks that the device answers in its current binary mode, with a
+// command that changes nothing: the mode version string in a protocol
+// mode, and a pin state read in bitbang mode. In UART mode RX echo must be
+// off.
+func (bp *BusPirate) Ping() error {
+	if err := bp.checkMode(binaryModes...); err != nil {
+		return err
+	}
+	if bp.mode == ModeBitbang {
+		dir := bp.pinDir
+		if dir == 0 {
+			dir = bbPinDir | pinAUX | pinMOSI | pinCLK | pinMISO | pinCS
+		}
+		_, err := bp.pinCmd(dir)
+		return err
+	}
+	if n, err := bp.write([]byte{modeVersionCmd}, writeTimeout); n == 0 || err != nil {
+		return bp.cmdError("error writing ping, n: %d, %w", n, timeoutErr(n, err))
+	}
+	if err := bp.drain(); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if n, err := bp.readFull(reply, bp.cmdTimeout()); err != nil || string(reply[:3]) != modeVersions[bp.mode] {
+		err = bp.cmdError("error reading ping reply, n: %d, %w", n, replyErr(n, err))
+		bp.flushInput()
+		return err
+	}
+	return nil
+}
+
+// WatchdogEvent reports a failed ping, or the recovery attempt that
+// follows too many of them in a row.
+type WatchdogEvent struct {
+	Err      error // the ping error, or the recovery error
+	Failures int   // consecutive failed pings
+	Recovery bool  // set for a recovery attempt
+}
+
+// Watchdog pings a BusPirate at an interval and, after a run of failed
+// pings, recovers it: the device is reset to bitbang mode with ToBitbang
+// and the mode and settings last seen working are restored with
+// RestoreConfig. A board that has been unplugged can't be recovered; the
+// failed recoveries are reported and retried at the next interval.
+//
+// A BusPirate isn't safe for concurrent use, so while the watchdog runs
+// every command must go through Do, which holds the watchdog's lock for
+// the call; a ping waits for an in-flight Do to finish, and a Do waits for
+// a ping or recovery.
+type Watchdog struct {
+	mu        sync.Mutex
+	bp        *BusPirate
+	interval  time.Duration
+	threshold int
+	onEvent   func(WatchdogEvent)
+}
+
+// NewWatchdog returns a watchdog for bp that pings every interval and
+// recovers after threshold consecutive failed pings. onEvent, if not nil,
+// is called from the watchdog's goroutine for every failure and recovery
+// attempt; it mustn't call Do.
+func NewWatchdog(bp *BusPirate, interval time.Duration, threshold int, onEvent func(WatchdogEvent)) *Watchdog {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Watchdog{bp: bp, interval: interval, threshold: threshold, onEvent: onEvent}
+}
+
+// Do runs fn with the BusPirate while no ping or recovery is in progress.
+func (w *Watchdog) Do(fn func(bp *BusPirate) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return fn(w.bp)
+}
+
+// Run pings the device until ctx is done, and returns the context's error.
+func (w *Watchdog) Run(ctx context.Context) error {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	// a Do may be changing the mode while Run starts
+	w.mu.Lock()
+	cfg := w.bp.SaveConfig()
+	w.mu.Unlock()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		w.mu.Lock()
+		if w.bp.Mode() == ModeText || w.bp.streaming.Load() {
+			// nothing to ping; a stream shows the device is alive
+			w.mu.Unlock()
+			continue
+		}
+		err := w.bp.Ping()
+		if err == nil {
+			failures = 0
+			cfg = w.bp.SaveConfig()
+			w.mu.Unlock()
+			continue
+		}
+		failures++
+		w.event(WatchdogEvent{Err: err, Failures: failures})
+		if failures >= w.threshold {
+			err := w.bp.ToBitbang()
+			if err == nil {
+				err = w.bp.RestoreConfig(cfg)
+			}
+			if err != nil {
+				err = fmt.Errorf("error recovering the device, %w", err)
+			} else {
+				failures = 0
+			}
+			w.event(WatchdogEvent{Err: err, Failures: failures, Recovery: true})
+		}
+		w.mu.Unlock()
+	}
+}
+
+func (w *Watchdog) event(ev WatchdogEvent) {
+	if w.onEvent != nil {
+		w.onEvent(ev)
+	}
+}
@@ -0,0 +1,67 @@
+package buspirate
+
+import (
+	"fmt"
+	"image/color"
+	"time"
+)
+
+const (
+	// ws2812Speed clocks 4 SPI bits per WS2812 bit, 1.54us, within the
+	// 1.25us +-600ns the LEDs accept.
+	ws2812Speed = SpiSpeed2600khz
+
+	// ws2812MaxPixels fits a frame in one write then read command; a frame
+	// split across commands would latch halfway through.
+	ws2812MaxPixels = 4096 / 12
+
+	// ws2812Reset is the low time that latches a frame, long enough for
+	// the newer parts' 280us.
+	ws2812Reset = 300 * time.Microsecond
+)
+
+// ws2812Symbols are the SPI bit patterns of a WS2812 0 and 1 bit at 2.6MHz,
+// 1000 and 1100: a 385ns or 770ns high, then low. The lows are longer than
+// the datasheet's, which the LEDs accept as they only time the high.
+var ws2812Symbols = [2]byte{0x8, 0xC}
+
+// WS2812Write sends a frame of colors to a chain of WS2812 (NeoPixel) LEDs
+// with DIN on MOSI, in SPI mode: each LED bit is 4 SPI bits at 2.6MHz, in
+// green, red, blue order, and alpha is ignored. A frame is at most 341
+// pixels, one write then read command, and is latched by holding the line
+// low for 300us. The SPI speed is restored afterwards and CS isn't
+// touched. The outputs must be set to 3.3V with SpiCfg.
+func (bp *BusPirate) WS2812Write(pixels []color.RGBA) error {
+	if err := bp.checkMode(ModeSpi); err != nil {
+		return err
+	}
+	if len(pixels) > ws2812MaxPixels {
+		return fmt.Errorf("error, ws2812 frame too long: %d pixels, must be at most %d", len(pixels), ws2812MaxPixels)
+	}
+	if bp.spiCfg&0x08 == 0 {
+		return fmt.Errorf("error, ws2812 needs 3.3v spi outputs, see SpiCfg")
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	out := make([]byte, 0, len(pixels)*12)
+	for _, p := range pixels {
+		for _, c := range []byte{p.G, p.R, p.B} {
+			for i := 7; i > 0; i -= 2 {
+				out = append(out, ws2812Symbols[c>>i&1]<<4|ws2812Symbols[c>>(i-1)&1])
+			}
+		}
+	}
+
+	prev := SpiSpeed(bp.spiSpeed & 0x07)
+	if err := bp.SpiSpeed(ws2812Speed); err != nil {
+		return err
+	}
+	_, err := bp.SpiWriteReadNoCS(out, 0)
+	time.Sleep(ws2812Reset)
+	if serr := bp.SpiSpeed(prev); err == nil {
+		err = serr
+	}
+	return err
+}